@@ -18,12 +18,14 @@ type KeyValueWriter interface {
 	Delete(key []byte) error
 }
 
+// KeyValueStore contains all the methods required to allow handling different
+// key-value data stores backing the high level database.
 type KeyValueStore interface {
 	KeyValueReader
-	// KeyValueWriter
+	KeyValueWriter
 	// KeyValueStater
 	Batcher
-	// Iteratee
+	Iteratee
 	// Compacter
 	// Snapshotter
 	// io.Closer
@@ -20,12 +20,14 @@ var (
 //
 // Trie is not safe for concurrent use.
 type Trie struct {
-	root node
+	root  node
+	owner common.Hash // Zero for the account trie, the account hash for storage tries
+	state common.Hash // Root of the state the trie belongs to, locates the nodes in the path scheme
 
 	// Keep track of the number leaves which have been inserted since the last
 	// hashing operation. This number will not directly map to the number of
 	// actually unhashed nodes.
-	// unhashed int
+	unhashed int
 
 	// reader is the handler trie can retrieve nodes from.
 	reader *TrieDB
@@ -33,6 +35,10 @@ type Trie struct {
 	// capture is the tool to track the trie changes.
 	// It will be reset after each commit operation.
 	capture *trieCapture
+
+	// witness records all the nodes loaded from the database, keyed by
+	// node hash. Nil if the witness collection is disabled.
+	witness map[common.Hash][]byte
 }
 
 // newFlag returns the cache flag value for a newly created node.
@@ -41,6 +47,8 @@ func (t *Trie) newFlag() nodeFlag {
 }
 
 // New creates the trie instance with provided trie id and the read-only database.
+// The trie is a storage trie of the account identified by id.Owner if the
+// owner is not zero, otherwise it's the account trie (or a standalone trie).
 // The state specified by trie id must be available, otherwise
 // an error will be returned. The trie root specified by trie id can be
 // zero hash or the sha3 hash of an empty string, then trie is initially
@@ -48,7 +56,10 @@ func (t *Trie) newFlag() nodeFlag {
 // a MissingNodeError if not.
 func New(id *ID, db *TrieDB) (*Trie, error) {
 	trie := &Trie{
-		reader: db,
+		owner:   id.Owner,
+		state:   id.StateRoot,
+		reader:  db,
+		capture: newTracer(),
 	}
 	if id.Root != (common.Hash{}) && id.Root != emptyRoot {
 		rootnode, err := trie.resolveAndTrack(id.Root[:], nil)
@@ -60,21 +71,42 @@ func New(id *ID, db *TrieDB) (*Trie, error) {
 	return trie, nil
 }
 
+// Copy returns a copy of Trie. The copy shares all the immutable trie nodes
+// with the original, the tracked changes are deep-copied, so both tries can
+// be modified and committed independently afterwards.
+func (t *Trie) Copy() *Trie {
+	return &Trie{
+		root:     t.root,
+		owner:    t.owner,
+		state:    t.state,
+		unhashed: t.unhashed,
+		reader:   t.reader,
+		capture:  t.capture.copy(),
+		witness:  t.copyWitness(),
+	}
+}
+
 // NewEmpty is a shortcut to create empty tree. It's mostly used in tests.
 func NewEmpty(db *TrieDB) *Trie {
 	trie, _ := New(TrieID(common.Hash{}), db)
 	return trie
 }
 
+// Get returns the value for key stored in the trie.
 // The value bytes must not be modified by the caller.
+// It panics if a trie node on the path can't be resolved,
+// use TryGet to handle the MissingNodeError instead.
 func (t *Trie) Get(key []byte) []byte {
 	res, err := t.TryGet(key)
 	if err != nil {
+		panic(fmt.Sprintf("unhandled trie error in Trie.Get: %v", err))
 	}
 	return res
 }
 
+// TryGet returns the value for key stored in the trie.
 // The value bytes must not be modified by the caller.
+// If a node was not found in the database, a MissingNodeError is returned.
 func (t *Trie) TryGet(key []byte) ([]byte, error) {
 	value, newroot, didResolve, err := t.tryGet(t.root, keybytesToHex(key), 0)
 	if err == nil && didResolve {
@@ -136,6 +168,7 @@ func (t *Trie) resolveAndTrack(n hashNode, prefix []byte) (node, error) {
 		return nil, err
 	}
 	t.capture.onRead(prefix, blob)
+	t.recordWitness(common.BytesToHash(n), blob)
 	return mustDecodeNode(n, blob), nil
 }
 
@@ -155,10 +188,36 @@ func (t *Trie) Hash() common.Hash {
 // Once the trie is committed, it's not usable anymore.
 // A new trie must be created with new root and updated trie database for following usage
 func (t *Trie) Commit(collectLeaf bool) (common.Hash, *NodeSet, error) {
+	return t.commit(collectLeaf, false)
+}
+
+// CommitParallel is the concurrent version of Commit. The children of the
+// topmost fullnode are committed in parallel, which speeds up the commit of
+// large tries with many dirty subtries. The returned nodeset is identical
+// to the one of Commit, including the children-before-parent node order.
+func (t *Trie) CommitParallel(collectLeaf bool) (common.Hash, *NodeSet, error) {
+	return t.commit(collectLeaf, true)
+}
+
+// commit is the internal version of Commit and CommitParallel.
+func (t *Trie) commit(collectLeaf bool, parallel bool) (common.Hash, *NodeSet, error) {
+	defer t.capture.reset()
+
+	// The trie is empty, but it can still happen that all the nodes are
+	// deleted since the last commit. Report these deletions so that they
+	// can be removed from the database.
 	if t.root == nil {
-		return emptyRoot, nil, nil
+		nodes := NewNodeSet(t.owner)
+		for _, path := range t.capture.deleteList() {
+			if oldv := t.capture.getOldv(path); len(oldv) != 0 {
+				nodes.markDeleted(path, oldv)
+			}
+		}
+		if len(nodes.deletes) == 0 {
+			return emptyRoot, nil, nil
+		}
+		return emptyRoot, nodes, nil
 	}
-	defer t.capture.reset()
 
 	// Derive the hash for all dirty nodes first. We hold the assumption
 	// in the following procedure that all nodes are hashed.
@@ -172,8 +231,7 @@ func (t *Trie) Commit(collectLeaf bool) (common.Hash, *NodeSet, error) {
 		t.root = hashedNode
 		return rootHash, nil, nil
 	}
-	owner := common.Hash{}
-	h := newCommitter(NewNodeSet(owner), t.capture, collectLeaf)
+	h := newCommitter(NewNodeSet(t.owner), t.capture, collectLeaf, parallel)
 	newRoot, nodes, err := h.Commit(t.root)
 	if err != nil {
 		return common.Hash{}, nil, err
@@ -188,20 +246,45 @@ func (t *Trie) hashRoot() (node, node, error) {
 		return hashNode(emptyRoot[:]), nil, nil
 	}
 	// If the number of changes is below 100, we let one thread handle it
-	h := newHasher()
-	defer returnHasherToPool(h)
+	h := newHasher(t.unhashed >= 100)
+	defer func() {
+		returnHasherToPool(h)
+		t.unhashed = 0
+	}()
 	hashed, cached := h.hash(t.root, true)
 	return hashed, cached, nil
 }
 
+// Update associates key with value in the trie. Subsequent calls to
+// Get will return value. If value has length zero, any existing value
+// is deleted from the trie and calls to Get will return nil.
+//
+// The value bytes must not be modified by the caller while they are
+// stored in the trie. It panics if a trie node on the path can't be
+// resolved, use TryUpdate to handle the MissingNodeError instead.
 func (t *Trie) Update(key, value []byte) {
-	if err := t.tryUpdate(key, value); err != nil {
+	if err := t.TryUpdate(key, value); err != nil {
+		panic(fmt.Sprintf("unhandled trie error in Trie.Update: %v", err))
 	}
 }
 
+// TryUpdate associates key with value in the trie. Subsequent calls to
+// Get will return value. If value has length zero, any existing value
+// is deleted from the trie and calls to Get will return nil.
+//
+// The value bytes must not be modified by the caller while they are
+// stored in the trie.
+//
+// If a node was not found in the database, a MissingNodeError is returned
+// and the trie is left unchanged.
+func (t *Trie) TryUpdate(key, value []byte) error {
+	return t.tryUpdate(key, value)
+}
+
 // tryUpdate expects an RLP-encoded value and performs the core function
 // for TryUpdate and TryUpdateAccount.
 func (t *Trie) tryUpdate(key, value []byte) error {
+	t.unhashed++
 	k := keybytesToHex(key)
 	if len(value) != 0 {
 		_, n, err := t.insert(t.root, nil, k, valueNode(value))
@@ -300,6 +383,29 @@ func (t *Trie) insert(n node, prefix, key []byte, value node) (bool, node, error
 	}
 }
 
+// Delete removes any existing value for key from the trie. It panics if
+// a trie node on the path can't be resolved, use TryDelete to handle the
+// MissingNodeError instead.
+func (t *Trie) Delete(key []byte) {
+	if err := t.TryDelete(key); err != nil {
+		panic(fmt.Sprintf("unhandled trie error in Trie.Delete: %v", err))
+	}
+}
+
+// TryDelete removes any existing value for key from the trie.
+// If a node was not found in the database, a MissingNodeError is returned
+// and the trie is left unchanged.
+func (t *Trie) TryDelete(key []byte) error {
+	t.unhashed++
+	k := keybytesToHex(key)
+	_, n, err := t.delete(t.root, nil, k)
+	if err != nil {
+		return err
+	}
+	t.root = n
+	return nil
+}
+
 // delete returns the new root of the trie with key deleted.
 // It reduces the trie to minimal form by simplifying
 // nodes on the way up after deleting recursively.
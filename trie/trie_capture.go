@@ -1,5 +1,24 @@
 package trie
 
+// trieCapture tracks the changes of trie nodes. During the trie operations,
+// some nodes can be deleted from the trie, while these deleted nodes won't
+// be captured by trie.Hasher or trie.Committer. Thus, these deleted nodes
+// won't be removed from the disk at all. trieCapture is an auxiliary tool
+// used to track all insert and delete operations of trie and capture all
+// deleted nodes eventually.
+//
+// The changed nodes can be mainly divided into two categories: the leaf
+// node and intermediate node. The former is inserted/deleted by callers
+// while the latter is inserted/deleted in order to follow the rule of trie.
+// This tool can track all of them no matter the node is embedded in its
+// parent or not, but valueNode is never tracked.
+//
+// Besides, it's also used for recording the original value of the nodes
+// when they are resolved from the disk. The pre-value of the nodes will
+// be used to construct reverse-diffs in the future.
+//
+// Note the tracer is not thread-safe, callers should be responsible for
+// handling the concurrency issues by themselves.
 type trieCapture struct {
 	insert map[string]struct{}
 	delete map[string]struct{}
@@ -18,7 +37,6 @@ func newTracer() *trieCapture {
 // onRead tracks the newly loaded trie node and caches the rlp-encoded blob internally.
 // Don't change the value outside of function since it's not deep-copied.
 func (t *trieCapture) onRead(path []byte, val []byte) {
-	// Tracer isn't used right now, remove this check later.
 	if t == nil {
 		return
 	}
@@ -28,7 +46,6 @@ func (t *trieCapture) onRead(path []byte, val []byte) {
 // onInsert tracks the newly inserted trie node. If it's already in the deletion set
 // (resurrected node), then just wipe it from the deletion set as the "untouched".
 func (t *trieCapture) onInsert(path []byte) {
-	// Tracer isn't used right now, remove this check later.
 	if t == nil {
 		return
 	}
@@ -43,7 +60,6 @@ func (t *trieCapture) onInsert(path []byte) {
 // in the addition set, then just wipe it from the addition set
 // as it's untouched.
 func (t *trieCapture) onDelete(path []byte) {
-	// Tracer isn't used right now, remove this check later.
 	if t == nil {
 		return
 	}
@@ -56,7 +72,6 @@ func (t *trieCapture) onDelete(path []byte) {
 
 // insertList returns the tracked inserted trie nodes in list format.
 func (t *trieCapture) insertList() [][]byte {
-	// Tracer isn't used right now, remove this check later.
 	if t == nil {
 		return nil
 	}
@@ -69,7 +84,6 @@ func (t *trieCapture) insertList() [][]byte {
 
 // deleteList returns the tracked deleted trie nodes in list format.
 func (t *trieCapture) deleteList() [][]byte {
-	// Tracer isn't used right now, remove this check later.
 	if t == nil {
 		return nil
 	}
@@ -82,7 +96,6 @@ func (t *trieCapture) deleteList() [][]byte {
 
 // getOldv returns the cached original value of the specified node.
 func (t *trieCapture) getOldv(path []byte) []byte {
-	// Tracer isn't used right now, remove this check later.
 	if t == nil {
 		return nil
 	}
@@ -91,7 +104,6 @@ func (t *trieCapture) getOldv(path []byte) []byte {
 
 // reset clears the content tracked by tracer.
 func (t *trieCapture) reset() {
-	// Tracer isn't used right now, remove this check later.
 	if t == nil {
 		return
 	}
@@ -102,7 +114,6 @@ func (t *trieCapture) reset() {
 
 // copy returns a deep copied tracer instance.
 func (t *trieCapture) copy() *trieCapture {
-	// Tracer isn't used right now, remove this check later.
 	if t == nil {
 		return nil
 	}
@@ -2,6 +2,7 @@ package trie
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/jaiminpan/mt-trie/common"
 )
@@ -13,14 +14,16 @@ type committer struct {
 	nodes       *NodeSet
 	capture     *trieCapture
 	collectLeaf bool
+	parallel    bool // Whether to commit the children of the topmost fullnode concurrently
 }
 
 // newCommitter creates a new committer or picks one from the pool.
-func newCommitter(nodes *NodeSet, capture *trieCapture, collectLeaf bool) *committer {
+func newCommitter(nodes *NodeSet, capture *trieCapture, collectLeaf bool, parallel bool) *committer {
 	return &committer{
 		nodes:       nodes,
 		capture:     capture,
 		collectLeaf: collectLeaf,
+		parallel:    parallel,
 	}
 }
 
@@ -75,7 +78,15 @@ func (c *committer) commit(path []byte, n node) (node, error) {
 		return c.nodeCommit(path, collapsed)
 
 	case *fullNode:
-		hashedKids, err := c.commitChildren(path, cn)
+		var (
+			hashedKids [17]node
+			err        error
+		)
+		if c.parallel {
+			hashedKids, err = c.commitChildrenParallel(path, cn)
+		} else {
+			hashedKids, err = c.commitChildren(path, cn)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -121,6 +132,60 @@ func (c *committer) commitChildren(path []byte, n *fullNode) ([17]node, error) {
 	return children, nil
 }
 
+// commitChildrenParallel commits the children of the given fullnode concurrently.
+// Every child subtrie is committed into its own node set by a dedicated committer,
+// the sets are merged afterwards in the order of the children. The nodes of each
+// subtrie precede the parent fullnode, which is only committed once all children
+// are done, so the children-before-parent ordering of the merged set is retained.
+func (c *committer) commitChildrenParallel(path []byte, n *fullNode) ([17]node, error) {
+	var (
+		children [17]node
+		sets     [16]*NodeSet
+		errs     [16]error
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < 16; i++ {
+		child := n.Children[i]
+		if child == nil {
+			continue
+		}
+		// If it's the hashed child, save the hash value directly.
+		if hn, ok := child.(hashNode); ok {
+			children[i] = hn
+			continue
+		}
+		// The tracer is only read during the commit, it's safe to share.
+		sets[i] = NewNodeSet(c.nodes.owner)
+		sub := newCommitter(sets[i], c.capture, c.collectLeaf, false)
+
+		// The child path must not share the backing array with the siblings.
+		childPath := make([]byte, len(path)+1)
+		copy(childPath, path)
+		childPath[len(path)] = byte(i)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			children[i], errs[i] = sub.commit(childPath, child)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 16; i++ {
+		if errs[i] != nil {
+			return children, errs[i]
+		}
+		if sets[i] != nil {
+			c.nodes.merge(sets[i])
+		}
+	}
+	// For the 17th child, it's possible the type is valuenode.
+	if n.Children[16] != nil {
+		children[16] = n.Children[16]
+	}
+	return children, nil
+}
+
 func (c *committer) nodeCommit(path []byte, collapsed node) (node, error) {
 
 	// Larger nodes are replaced by their hash and stored in the database.
@@ -138,7 +203,7 @@ func (c *committer) nodeCommit(path []byte, collapsed node) (node, error) {
 			mnode = &memoryNode{
 				hash: nhash,
 				node: simplifyNode(collapsed),
-				// size: uint16(estimateSize(collapsed)),
+				size: uint16(estimateSize(collapsed)),
 			}
 		)
 		// Collect the dirty node to nodeset for return.
@@ -169,3 +234,32 @@ func (c *committer) nodeCommit(path []byte, collapsed node) (node, error) {
 	}
 	return collapsed, nil
 }
+
+// estimateSize estimates the size of an rlp-encoded node, without actually
+// rlp-encoding it (zero allocs). This method has been experimentally tried, and with a trie
+// with 1000 leaves, the only errors above 1% are on small shortnodes, where this
+// method overestimates by 2 or 3 bytes (e.g. 37 instead of 35)
+func estimateSize(n node) int {
+	switch n := n.(type) {
+	case *shortNode:
+		// A short node contains a compacted key, and a value.
+		return 3 + len(n.Key) + estimateSize(n.Val)
+	case *fullNode:
+		// A full node contains up to 16 hashes (some nils), and a key
+		s := 3
+		for i := 0; i < 16; i++ {
+			if child := n.Children[i]; child != nil {
+				s += estimateSize(child)
+			} else {
+				s++
+			}
+		}
+		return s
+	case valueNode:
+		return 1 + len(n)
+	case hashNode:
+		return 1 + len(n)
+	default:
+		panic(fmt.Sprintf("node type %T", n))
+	}
+}
@@ -11,51 +11,125 @@ import (
 	"github.com/jaiminpan/mt-trie/types"
 )
 
+// Config defines all necessary options for the trie database.
+type Config struct {
+	Cache        int    // Memory allowance (MB) to use for caching clean trie nodes in memory
+	Scheme       string // Node storage scheme, HashScheme if empty
+	DiffLayers   int    // Number of diff layers kept in memory in the path scheme, 128 if zero
+	ReverseDiffs int    // Number of reverse diffs retained for rollback, 128 if zero
+}
+
 type TrieDB struct {
 	diskdb accdb.KeyValueStore // Persistent storage for matured trie nodes
+	scheme string              // Node storage scheme, HashScheme or PathScheme
+
+	cleans    *cleanCache    // LRU cache of persisted trie nodes, nil if disabled
+	preimages *preimageStore // Store for caching preimages of hashed trie keys
 
 	dirties map[common.Hash]*cachedNode // Data and references relationships of dirty trie nodes
 	oldest  common.Hash                 // Oldest tracked node, flush-list head
 	newest  common.Hash                 // Newest tracked node, flush-list tail
 
+	dirtiesSize  common.StorageSize // Storage size of the dirty node cache (exc. metadata)
+	childrenSize common.StorageSize // Storage size of the external children tracking
+
+	base   *diskLayer                 // Persisted layer of the path scheme, nil in the hash scheme
+	layers map[common.Hash]*diffLayer // In-memory diff layers of the path scheme, keyed by state root
+	head   common.Hash                // State root of the most recent diff layer
+	depth  int                        // Number of diff layers kept in memory
+
+	diffHead  uint64      // Identifier of the most recent reverse diff, 0 if none
+	diffRoot  common.Hash // Most recent state root in the hash scheme, reverted by Rollback
+	diffLimit uint64      // Number of the most recent reverse diffs retained
+
 	lock sync.RWMutex
 }
 
 // creates a new trie database to store ephemeral trie content before
 // its written out to disk or garbage collected. No read cache is created, so all
-// data retrievals will hit the underlying disk database.
+// data retrievals will hit the underlying disk database. The nodes are stored
+// in the hash scheme.
 func NewTrieDB(diskdb accdb.KeyValueStore) *TrieDB {
 	db := &TrieDB{
 		diskdb: diskdb,
+		scheme: HashScheme,
 		dirties: map[common.Hash]*cachedNode{{}: {
 			children: make(map[common.Hash]uint16),
 		}},
+		preimages: newPreimageStore(diskdb),
+		diffHead:  readReverseDiffHead(diskdb),
+		diffLimit: defaultReverseDiffs,
 	}
+	db.diffRoot = readReverseDiffRoot(diskdb, db.diffHead)
 	return db
 }
 
-// NewDatabaseWithConfig creates a new trie database to store ephemeral trie content
+// NewTrieDBWithConfig creates a new trie database to store ephemeral trie content
 // before its written out to disk or garbage collected. It also acts as a read cache
 // for nodes loaded from disk.
-func NewTrieDBWithConfig(diskdb accdb.KeyValueStore) *TrieDB {
-	db := &TrieDB{
-		diskdb: diskdb,
-		dirties: map[common.Hash]*cachedNode{{}: {
-			children: make(map[common.Hash]uint16),
-		}},
+func NewTrieDBWithConfig(diskdb accdb.KeyValueStore, config *Config) *TrieDB {
+	db := NewTrieDB(diskdb)
+	if config != nil && config.Cache > 0 {
+		db.cleans = newCleanCache(config.Cache * 1024 * 1024)
+	}
+	if config != nil && config.ReverseDiffs > 0 {
+		db.diffLimit = uint64(config.ReverseDiffs)
+	}
+	if config != nil && config.Scheme == PathScheme {
+		db.scheme = PathScheme
+		db.resetLayers(readDiskLayerRoot(diskdb))
+
+		db.depth = defaultDiffLayers
+		if config.DiffLayers > 0 {
+			db.depth = config.DiffLayers
+		}
 	}
 	return db
 }
 
-// Node retrieves the trie node with the given node hash.
+// Scheme returns the node storage scheme of the database.
+func (db *TrieDB) Scheme() string {
+	return db.scheme
+}
+
+// Node retrieves the trie node with the given owner, path and node hash. The
+// owner and path are only used to locate the node in the path scheme, where
+// the node is looked up in the most recent state.
 // No error will be returned if the node is not found.
-func (db *TrieDB) Node(_ common.Hash, _ []byte, hash common.Hash) (node, error) {
-	return db.node(hash), nil
+func (db *TrieDB) Node(owner common.Hash, path []byte, hash common.Hash) (node, error) {
+	return db.stateNode(common.Hash{}, owner, path, hash)
 }
 
-// NodeBlob retrieves the RLP-encoded trie node blob with the given node hash.
+// NodeBlob retrieves the RLP-encoded trie node blob with the given owner, path
+// and node hash. The owner and path are only used to locate the node in the
+// path scheme, where the node is looked up in the most recent state.
 // No error will be returned if the node is not found.
-func (db *TrieDB) NodeBlob(_ common.Hash, _ []byte, hash common.Hash) ([]byte, error) {
+func (db *TrieDB) NodeBlob(owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
+	return db.stateNodeBlob(common.Hash{}, owner, path, hash)
+}
+
+// stateNode retrieves the trie node with the given owner, path and node hash
+// in the given state. The state is only used to locate the layer to start the
+// lookup from in the path scheme, zero means the most recent state.
+func (db *TrieDB) stateNode(state common.Hash, owner common.Hash, path []byte, hash common.Hash) (node, error) {
+	if db.scheme == PathScheme {
+		blob := db.pathNodeBlob(state, owner, path, hash)
+		if blob == nil {
+			return nil, nil
+		}
+		return mustDecodeNode(hash[:], blob), nil
+	}
+	return db.node(hash), nil
+}
+
+// stateNodeBlob retrieves the RLP-encoded trie node blob with the given owner,
+// path and node hash in the given state. The state is only used to locate the
+// layer to start the lookup from in the path scheme, zero means the most
+// recent state.
+func (db *TrieDB) stateNodeBlob(state common.Hash, owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
+	if db.scheme == PathScheme {
+		return db.pathNodeBlob(state, owner, path, hash), nil
+	}
 	blob, _ := db.nodeBlob(hash)
 	return blob, nil
 }
@@ -73,11 +147,21 @@ func (db *TrieDB) node(hash common.Hash) node {
 		return dirty.obj(hash)
 	}
 
+	// Retrieve the node from the clean cache if available
+	if db.cleans != nil {
+		if enc := db.cleans.get(hash[:]); enc != nil {
+			return mustDecodeNode(hash[:], enc)
+		}
+	}
 	// Content unavailable in memory, attempt to retrieve from disk
 	enc, err := db.diskdb.Get(hash[:])
 	if err != nil || enc == nil {
 		return nil
 	}
+	if db.cleans != nil {
+		db.cleans.set(hash[:], enc)
+		return mustDecodeNode(hash[:], enc)
+	}
 	// The returned value from database is in its own copy,
 	// safe to use mustDecodeNodeUnsafe for decoding.
 	return mustDecodeNodeUnsafe(hash[:], enc)
@@ -99,11 +183,20 @@ func (db *TrieDB) nodeBlob(hash common.Hash) ([]byte, error) {
 		return dirty.rlp(), nil
 	}
 
+	// Retrieve the node from the clean cache if available
+	if db.cleans != nil {
+		if enc := db.cleans.get(hash[:]); enc != nil {
+			return enc, nil
+		}
+	}
 	// Content unavailable in memory, attempt to retrieve from disk
 	enc, _ := db.diskdb.Get(hash[:])
 	if len(enc) == 0 {
 		return nil, errors.New("not found")
 	}
+	if db.cleans != nil {
+		db.cleans.set(hash[:], enc)
+	}
 	return enc, nil
 }
 
@@ -120,13 +213,22 @@ func (db *TrieDB) Nodes() []common.Hash {
 			hashes = append(hashes, hash)
 		}
 	}
+	for _, dl := range db.layers {
+		for _, subset := range dl.nodes {
+			for _, n := range subset {
+				if n.hash != (common.Hash{}) { // Special case for deleted nodes
+					hashes = append(hashes, n.hash)
+				}
+			}
+		}
+	}
 	return hashes
 }
 
 // inserts a simplified trie node into the memory database.
 // All nodes inserted by this function will be reference tracked
 // and in theory should only used for **trie nodes** insertion.
-func (db *TrieDB) insert(hash common.Hash, node node) {
+func (db *TrieDB) insert(hash common.Hash, size int, node node) {
 	// If the node's already cached, skip
 	if _, ok := db.dirties[hash]; ok {
 		return
@@ -135,6 +237,7 @@ func (db *TrieDB) insert(hash common.Hash, node node) {
 	// Create the cached entry for this node
 	entry := &cachedNode{
 		node: node,
+		size: uint16(size),
 	}
 	entry.forChilds(func(child common.Hash) {
 		if c := db.dirties[child]; c != nil {
@@ -150,14 +253,34 @@ func (db *TrieDB) insert(hash common.Hash, node node) {
 	} else {
 		db.dirties[db.newest].flushNext, db.newest = hash, hash
 	}
+	db.dirtiesSize += common.StorageSize(common.HashLength + entry.size)
 }
 
-// inserts the dirty nodes in provided nodeset into database and
-// link the account trie with multiple storage tries if necessary.
-func (db *TrieDB) Update(nodes *MergedNodeSet) error {
+// Update inserts the dirty nodes in provided nodeset into database and
+// link the account trie with multiple storage tries if necessary. The
+// nodeset is expected to transform the state from parent to root. The
+// previous values of all the touched nodes are persisted as a reverse
+// diff, which allows rolling the database back to parent later.
+//
+// In the path scheme the nodes form a new diff layer on top of the parent
+// state, no references are tracked. The layers exceeding the configured
+// depth are flattened into the disk.
+func (db *TrieDB) Update(root common.Hash, parent common.Hash, nodes *MergedNodeSet) error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
+	if db.scheme == PathScheme {
+		// Skip noop updates and the states already known, neither a
+		// layer nor a reverse diff is created for them.
+		if root == parent || db.layer(root) != nil {
+			return nil
+		}
+		if err := db.updateLayers(root, parent, nodes); err != nil {
+			return err
+		}
+		return db.storeReverseDiff(root, parent, nodes)
+	}
+
 	// Insert dirty nodes into the database. In the same tree, it must be
 	// ensured that children are inserted first, then parent so that children
 	// can be linked with their parent correctly.
@@ -182,7 +305,7 @@ func (db *TrieDB) Update(nodes *MergedNodeSet) error {
 			if !ok {
 				return fmt.Errorf("missing node %x %v", owner, path)
 			}
-			db.insert(n.hash, n.node)
+			db.insert(n.hash, int(n.size), n.node)
 		}
 	}
 	// Link up the account trie and storage trie
@@ -198,9 +321,21 @@ func (db *TrieDB) Update(nodes *MergedNodeSet) error {
 			}
 		}
 	}
-	return nil
+	return db.storeReverseDiff(root, parent, nodes)
+}
+
+// Reference adds a new reference from a parent node to a child node. This
+// function is used to add reference between internal trie node and external
+// node(e.g. storage trie root) or to retain a state root in the dirty cache
+// by referencing it from the meta root (zero hash).
+func (db *TrieDB) Reference(child common.Hash, parent common.Hash) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.reference(child, parent)
 }
 
+// reference is the private locked version of Reference.
 func (db *TrieDB) reference(child common.Hash, parent common.Hash) {
 	// If the node does not exist, it's a node pulled from disk, skip
 	node, ok := db.dirties[child]
@@ -210,13 +345,32 @@ func (db *TrieDB) reference(child common.Hash, parent common.Hash) {
 	// If the reference already exists, only duplicate for roots
 	if db.dirties[parent].children == nil {
 		db.dirties[parent].children = make(map[common.Hash]uint16)
+		db.childrenSize += cachedNodeChildrenSize
 	} else if _, ok = db.dirties[parent].children[child]; ok && parent != (common.Hash{}) {
 		return
 	}
 	node.parents++
 	db.dirties[parent].children[child]++
+	if db.dirties[parent].children[child] == 1 {
+		db.childrenSize += common.HashLength + 2 // uint16 counter
+	}
+}
+
+// Dereference removes an existing reference from a root node. The dirty nodes
+// which are not referenced by any other node anymore are dropped from the
+// dirty cache, the nodes shared with other retained roots are kept.
+func (db *TrieDB) Dereference(root common.Hash) {
+	// Sanity check to ensure that the meta-root is not removed
+	if root == (common.Hash{}) {
+		return
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.dereference(root, common.Hash{})
 }
 
+// dereference is the private locked version of Dereference.
 func (db *TrieDB) dereference(child common.Hash, parent common.Hash) {
 	// Dereference the parent-child
 	node := db.dirties[parent]
@@ -225,6 +379,7 @@ func (db *TrieDB) dereference(child common.Hash, parent common.Hash) {
 		node.children[child]--
 		if node.children[child] == 0 {
 			delete(node.children, child)
+			db.childrenSize -= (common.HashLength + 2) // uint16 counter
 		}
 	}
 	// If the child does not exist, it's a previously committed node.
@@ -258,22 +413,174 @@ func (db *TrieDB) dereference(child common.Hash, parent common.Hash) {
 			db.dereference(hash, child)
 		})
 		delete(db.dirties, child)
+		db.dirtiesSize -= common.StorageSize(common.HashLength + int(node.size))
+		if node.children != nil {
+			db.childrenSize -= cachedNodeChildrenSize
+		}
+	}
+}
+
+// Cap iteratively flushes old but still referenced trie nodes until the total
+// memory usage goes below the given threshold. In the path scheme the bottom
+// diff layers of the most recent state are flattened into the disk instead.
+//
+// Note, this method is a non-synchronized mutator. It is unsafe to call this
+// concurrently with other mutators.
+func (db *TrieDB) Cap(limit common.StorageSize) error {
+	if db.scheme == PathScheme {
+		if err := db.preimages.commit(false); err != nil {
+			return err
+		}
+		db.lock.Lock()
+		defer db.lock.Unlock()
+
+		var chain []*diffLayer
+		for dl, ok := db.layers[db.head]; ok; dl, ok = dl.parent.(*diffLayer) {
+			chain = append(chain, dl)
+		}
+		for len(chain) > 0 && db.layersSize() > limit {
+			if err := db.flatten(chain[len(chain)-1]); err != nil {
+				return err
+			}
+			chain = chain[:len(chain)-1]
+		}
+		return nil
 	}
+	// Create a database batch to flush persistent data out. It is important that
+	// outside code doesn't see an inconsistent state (referenced data removed from
+	// memory cache during commit but not yet in persistent storage). This is ensured
+	// by only uncaching existing data when the database write finalizes.
+	batch := db.diskdb.NewBatch()
+
+	// If the preimage cache got large enough, push to disk. If it's still small
+	// leave for later to deduplicate writes.
+	if err := db.preimages.commit(false); err != nil {
+		return err
+	}
+	// db.dirtiesSize only contains the useful data in the cache, but when reporting
+	// the total memory consumption, the maintenance metadata is also needed to be
+	// counted.
+	db.lock.RLock()
+	size := db.dirtiesSize + common.StorageSize((len(db.dirties)-1)*cachedNodeSize)
+	size += db.childrenSize - common.StorageSize(len(db.dirties[common.Hash{}].children)*(common.HashLength+2))
+
+	// Keep committing nodes from the flush-list until we're below allowance
+	oldest := db.oldest
+	for size > limit && oldest != (common.Hash{}) {
+		// Fetch the oldest referenced node and push into the batch
+		node := db.dirties[oldest]
+		if err := batch.Put(oldest[:], node.rlp()); err != nil {
+			db.lock.RUnlock()
+			return err
+		}
+		// If we exceeded the ideal batch size, commit and reset
+		if batch.ValueSize() >= accdb.IdealBatchSize {
+			if err := batch.Submit(); err != nil {
+				db.lock.RUnlock()
+				return err
+			}
+			batch.Reset()
+		}
+		// Iterate to the next flush item, or abort if the size cap was achieved. Size
+		// is the total size, including the useful cached data (hash -> blob), the
+		// cache item metadata, as well as external children mappings.
+		size -= common.StorageSize(common.HashLength + int(node.size) + cachedNodeSize)
+		if node.children != nil {
+			size -= common.StorageSize(cachedNodeChildrenSize + len(node.children)*(common.HashLength+2))
+		}
+		oldest = node.flushNext
+	}
+	db.lock.RUnlock()
+
+	// Flush out any remainder data from the last batch
+	if err := batch.Submit(); err != nil {
+		return err
+	}
+	// Write successful, clear out the flushed data
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	for db.oldest != oldest {
+		node := db.dirties[db.oldest]
+		delete(db.dirties, db.oldest)
+		if db.cleans != nil {
+			db.cleans.set(db.oldest[:], node.rlp())
+		}
+		db.oldest = node.flushNext
+
+		db.dirtiesSize -= common.StorageSize(common.HashLength + int(node.size))
+		if node.children != nil {
+			db.childrenSize -= common.StorageSize(cachedNodeChildrenSize + len(node.children)*(common.HashLength+2))
+		}
+	}
+	if db.oldest != (common.Hash{}) {
+		db.dirties[db.oldest].flushPrev = common.Hash{}
+	}
+	return nil
+}
+
+// Size returns the current storage size of the memory cache in front of the
+// persistent database layer.
+func (db *TrieDB) Size() common.StorageSize {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	// db.dirtiesSize only contains the useful data in the cache, but when reporting
+	// the total memory consumption, the maintenance metadata is also needed to be
+	// counted.
+	var metadataSize = common.StorageSize((len(db.dirties) - 1) * cachedNodeSize)
+	var metarootRefs = common.StorageSize(len(db.dirties[common.Hash{}].children) * (common.HashLength + 2))
+	return db.dirtiesSize + db.childrenSize + metadataSize - metarootRefs + db.layersSize() + db.preimages.size()
+}
+
+// Preimage retrieves the preimage of a hashed trie key, either from the
+// memory cache or from the persistent database. Nil is returned if the
+// preimage is unknown.
+func (db *TrieDB) Preimage(hash common.Hash) []byte {
+	return db.preimages.preimage(hash)
+}
+
+// CleanCacheStats returns the number of clean cache hits and misses since
+// the database was created. Zeros are returned if the cache is disabled.
+func (db *TrieDB) CleanCacheStats() (hits uint64, misses uint64) {
+	if db.cleans == nil {
+		return 0, 0
+	}
+	return db.cleans.stats()
 }
 
 // Commit iterates over all the children of a particular node, writes them out
 // to disk, forcefully tearing down all references in both directions. As a side
 // effect, all pre-images accumulated up to this point are also written.
 //
+// In the path scheme the diff layers of the given state are flattened into
+// the disk, dropping all the states which are not descendants of it.
+//
 // Note, this method is a non-synchronized mutator. It is unsafe to call this
 // concurrently with other mutators.
 func (db *TrieDB) Commit(node common.Hash) error {
+	if db.scheme == PathScheme {
+		if err := db.preimages.commit(true); err != nil {
+			return err
+		}
+		db.lock.Lock()
+		defer db.lock.Unlock()
+
+		if db.layer(node) == nil {
+			return fmt.Errorf("state %x is not available", node)
+		}
+		return db.capLayers(node, 0)
+	}
 	// Create a database batch to flush persistent data out. It is important that
 	// outside code doesn't see an inconsistent state (referenced data removed from
 	// memory cache during commit but not yet in persistent storage). This is ensured
 	// by only uncaching existing data when the database write finalizes.
 	batch := db.diskdb.NewBatch()
 
+	// Move all of the accumulated preimages into a write batch
+	if err := db.preimages.commit(true); err != nil {
+		return err
+	}
 	uncacher := &cleaner{db}
 	if err := db.commit(node, batch, uncacher); err != nil {
 		return err
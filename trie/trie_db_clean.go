@@ -0,0 +1,104 @@
+package trie
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// cleanEntry is a single trie node blob held in the clean cache.
+type cleanEntry struct {
+	key  string
+	blob []byte
+}
+
+// cleanCache is a size-bounded LRU cache of RLP-encoded trie nodes which are
+// already persisted in the disk database. The nodes are keyed by node hash in
+// the hash scheme and by owner and path in the path scheme, so the cached
+// node of a path might be a version other than the requested one. It is safe
+// for concurrent use.
+type cleanCache struct {
+	hits   uint64 // Number of retrievals served from the cache (atomic)
+	misses uint64 // Number of retrievals not found in the cache (atomic)
+
+	limit int                      // Maximum storage size of the cached blobs
+	size  int                      // Current storage size of the cached blobs
+	items map[string]*list.Element // Cached entries keyed by node key
+	order *list.List               // Recency list, most recently used at the front
+
+	lock sync.Mutex
+}
+
+// newCleanCache creates a clean cache with the given storage allowance in bytes.
+func newCleanCache(limit int) *cleanCache {
+	return &cleanCache{
+		limit: limit,
+		items: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+// get retrieves the node blob with the given key, nil is returned if it's
+// not cached. The returned blob must not be mutated by the caller.
+func (c *cleanCache) get(key []byte) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.items[string(key)]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil
+	}
+	atomic.AddUint64(&c.hits, 1)
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cleanEntry).blob
+}
+
+// set inserts the node blob with the given key, replacing the blob cached
+// under the key if any and evicting the least recently used entries if the
+// storage allowance is exceeded. Blobs larger than the whole allowance are
+// not cached.
+func (c *cleanCache) set(key []byte, blob []byte) {
+	size := len(key) + len(blob)
+	if size > c.limit {
+		c.del(key)
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.items[string(key)]; ok {
+		entry := elem.Value.(*cleanEntry)
+		c.size += len(blob) - len(entry.blob)
+		entry.blob = blob
+		c.order.MoveToFront(elem)
+	} else {
+		c.items[string(key)] = c.order.PushFront(&cleanEntry{key: string(key), blob: blob})
+		c.size += size
+	}
+	for c.size > c.limit {
+		elem := c.order.Back()
+		entry := elem.Value.(*cleanEntry)
+		c.order.Remove(elem)
+		delete(c.items, entry.key)
+		c.size -= len(entry.key) + len(entry.blob)
+	}
+}
+
+// del removes the node blob with the given key from the cache.
+func (c *cleanCache) del(key []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.items[string(key)]; ok {
+		entry := elem.Value.(*cleanEntry)
+		c.order.Remove(elem)
+		delete(c.items, entry.key)
+		c.size -= len(entry.key) + len(entry.blob)
+	}
+}
+
+// stats returns the number of cache hits and misses so far.
+func (c *cleanCache) stats() (uint64, uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
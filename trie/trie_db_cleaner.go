@@ -37,6 +37,14 @@ func (c *cleaner) Put(key []byte, rlp []byte) error {
 	}
 	// Remove the node from the dirty cache
 	delete(c.db.dirties, hash)
+	c.db.dirtiesSize -= common.StorageSize(common.HashLength + int(node.size))
+	if node.children != nil {
+		c.db.childrenSize -= common.StorageSize(cachedNodeChildrenSize + len(node.children)*(common.HashLength+2))
+	}
+	// Move the flushed node into the clean cache to prevent insta-reloads
+	if c.db.cleans != nil {
+		c.db.cleans.set(hash[:], rlp)
+	}
 	return nil
 }
 
@@ -0,0 +1,279 @@
+package trie
+
+import (
+	"fmt"
+
+	"github.com/jaiminpan/mt-trie/accdb"
+	"github.com/jaiminpan/mt-trie/common"
+)
+
+// defaultDiffLayers is the number of diff layers kept in memory in the path
+// scheme if it's not configured otherwise.
+const defaultDiffLayers = 128
+
+// diskLayerRootKey tracks the state root of the nodes persisted in the path scheme.
+var diskLayerRootKey = []byte("DiskLayerRoot")
+
+// readDiskLayerRoot retrieves the state root of the nodes persisted in the path
+// scheme, the empty root is returned if nothing is persisted yet.
+func readDiskLayerRoot(db accdb.KeyValueReader) common.Hash {
+	blob, _ := db.Get(diskLayerRootKey)
+	if len(blob) != common.HashLength {
+		return emptyRoot
+	}
+	return common.BytesToHash(blob)
+}
+
+// layer is a single version of the path keyed trie nodes, identified by the
+// state root. The layers form a tree: every diff layer sits on top of the
+// state it was created from, the bottom of the tree is the disk layer.
+type layer interface {
+	// rootHash returns the state root of the layer.
+	rootHash() common.Hash
+
+	// nodeBlob retrieves the RLP-encoded trie node identified by the owner,
+	// path and hash, walking down the layers until it's found. Nil is
+	// returned if the node under the path has a different hash.
+	nodeBlob(owner common.Hash, path []byte, hash common.Hash) []byte
+}
+
+// diskLayer is the bottom layer, the nodes of which are persisted in the disk.
+type diskLayer struct {
+	root common.Hash // State root of the persisted nodes
+	db   *TrieDB     // Database to read the persisted nodes from
+}
+
+// rootHash implements layer, returning the state root of the persisted nodes.
+func (dl *diskLayer) rootHash() common.Hash {
+	return dl.root
+}
+
+// nodeBlob implements layer, retrieving the node from the clean cache or from
+// the disk. The clean cache is keyed by owner and path in the path scheme, the
+// cached node is only returned if its hash matches.
+func (dl *diskLayer) nodeBlob(owner common.Hash, path []byte, hash common.Hash) []byte {
+	key := trieNodeKey(owner, path)
+
+	// Retrieve the node from the clean cache if available
+	if dl.db.cleans != nil {
+		if enc := dl.db.cleans.get(key); enc != nil && nodeHashMatches(enc, hash) {
+			return enc
+		}
+	}
+	// Content unavailable in memory, attempt to retrieve from disk
+	enc := readTrieNode(dl.db.diskdb, owner, path, hash, PathScheme)
+	if len(enc) == 0 {
+		return nil
+	}
+	if dl.db.cleans != nil {
+		dl.db.cleans.set(key, enc)
+	}
+	return enc
+}
+
+// diffLayer is an in-memory layer holding the nodes changed by a single
+// database update on top of its parent layer. Deleted nodes are tracked with
+// an empty entry, shadowing the nodes of the lower layers.
+type diffLayer struct {
+	root   common.Hash                            // State root of the layer
+	parent layer                                  // Layer the changes are applied on
+	nodes  map[common.Hash]map[string]*memoryNode // Changed nodes, keyed by owner and path
+	size   common.StorageSize                     // Storage size of the changed nodes
+}
+
+// newDiffLayer creates a diff layer with the nodes of the given node set on
+// top of the parent layer.
+func newDiffLayer(parent layer, root common.Hash, sets *MergedNodeSet) *diffLayer {
+	dl := &diffLayer{
+		root:   root,
+		parent: parent,
+		nodes:  make(map[common.Hash]map[string]*memoryNode),
+	}
+	for owner, set := range sets.sets {
+		subset := make(map[string]*memoryNode)
+
+		// The deletions go first, a path which is deleted and recreated
+		// in the same set must end up with the new node.
+		set.ForEachDeleted(func(path []byte, _ []byte) {
+			subset[string(path)] = &memoryNode{}
+		})
+		for _, path := range set.updates.order {
+			subset[path] = set.updates.nodes[path].memoryNode
+		}
+		for path, n := range subset {
+			dl.size += common.StorageSize(common.HashLength + len(path) + int(n.size))
+		}
+		dl.nodes[owner] = subset
+	}
+	return dl
+}
+
+// rootHash implements layer, returning the state root of the layer.
+func (dl *diffLayer) rootHash() common.Hash {
+	return dl.root
+}
+
+// nodeBlob implements layer, retrieving the node from the layer itself or
+// from the parent layers if it's not changed here.
+func (dl *diffLayer) nodeBlob(owner common.Hash, path []byte, hash common.Hash) []byte {
+	if n, ok := dl.nodes[owner][string(path)]; ok {
+		if n.hash != hash {
+			return nil
+		}
+		return n.rlp()
+	}
+	return dl.parent.nodeBlob(owner, path, hash)
+}
+
+// layer returns the layer of the given state root, nil if it's unknown.
+//
+// Note, this method assumes the database lock is held by the caller.
+func (db *TrieDB) layer(root common.Hash) layer {
+	if root == db.base.root {
+		return db.base
+	}
+	if dl, ok := db.layers[root]; ok {
+		return dl
+	}
+	return nil
+}
+
+// pathNodeBlob retrieves the RLP-encoded trie node identified by the owner,
+// path and hash in the path scheme, starting from the layer of the given
+// state. The most recent state is used if the state is zero, the disk layer
+// if the state is unknown.
+func (db *TrieDB) pathNodeBlob(state common.Hash, owner common.Hash, path []byte, hash common.Hash) []byte {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if state == (common.Hash{}) {
+		state = db.head
+	}
+	l := db.layer(state)
+	if l == nil {
+		l = db.base
+	}
+	return l.nodeBlob(owner, path, hash)
+}
+
+// updateLayers creates a diff layer for the nodes of the given node set on top
+// of the parent state, then flattens the layers exceeding the configured depth
+// into the disk. The caller must reject the noop updates and the states which
+// are already known.
+//
+// Note, this method assumes the database lock is held by the caller.
+func (db *TrieDB) updateLayers(root common.Hash, parent common.Hash, nodes *MergedNodeSet) error {
+	p := db.layer(parent)
+	if p == nil {
+		return fmt.Errorf("parent layer %x is missing", parent)
+	}
+	db.layers[root] = newDiffLayer(p, root, nodes)
+	db.head = root
+
+	return db.capLayers(root, db.depth)
+}
+
+// capLayers flattens the bottom diff layers of the given state into the disk
+// until at most the given number of diff layers is left below the state,
+// including the state itself.
+//
+// Note, this method assumes the database lock is held by the caller.
+func (db *TrieDB) capLayers(root common.Hash, depth int) error {
+	var chain []*diffLayer
+	for dl, ok := db.layers[root]; ok; dl, ok = dl.parent.(*diffLayer) {
+		chain = append(chain, dl)
+	}
+	for len(chain) > depth {
+		if err := db.flatten(chain[len(chain)-1]); err != nil {
+			return err
+		}
+		chain = chain[:len(chain)-1]
+	}
+	return nil
+}
+
+// flatten writes the nodes of the bottom diff layer into the disk, making it
+// the new disk layer. The diff layers built on other children of the previous
+// disk layer become unreachable and are dropped along with their descendants.
+//
+// Note, this method assumes the database lock is held by the caller.
+func (db *TrieDB) flatten(bottom *diffLayer) error {
+	batch := db.diskdb.NewBatch()
+	for owner, subset := range bottom.nodes {
+		for path, n := range subset {
+			var err error
+			if n.hash == (common.Hash{}) {
+				err = deleteTrieNode(batch, owner, []byte(path), PathScheme)
+			} else {
+				err = writeTrieNode(batch, owner, []byte(path), n.hash, n.rlp(), PathScheme)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := batch.Put(diskLayerRootKey, bottom.root[:]); err != nil {
+		return err
+	}
+	if err := batch.Submit(); err != nil {
+		return err
+	}
+	// Write successful, move the flushed nodes into the clean cache and
+	// evict the deleted ones
+	if db.cleans != nil {
+		for owner, subset := range bottom.nodes {
+			for path, n := range subset {
+				key := trieNodeKey(owner, []byte(path))
+				if n.hash == (common.Hash{}) {
+					db.cleans.del(key)
+				} else {
+					db.cleans.set(key, n.rlp())
+				}
+			}
+		}
+	}
+	prev := db.base
+	db.base = &diskLayer{root: bottom.root, db: db}
+	delete(db.layers, bottom.root)
+
+	// Relink the children of the flattened layer and drop the stale ones
+	stale := map[layer]bool{prev: true}
+	for removed := true; removed; {
+		removed = false
+		for root, dl := range db.layers {
+			switch {
+			case dl.parent == layer(bottom):
+				dl.parent = db.base
+			case stale[dl.parent]:
+				stale[dl] = true
+				delete(db.layers, root)
+				removed = true
+			}
+		}
+	}
+	if db.layer(db.head) == nil {
+		db.head = db.base.root
+	}
+	return nil
+}
+
+// resetLayers drops all the diff layers and marks the given state as the one
+// persisted in the disk.
+//
+// Note, this method assumes the database lock is held by the caller.
+func (db *TrieDB) resetLayers(root common.Hash) {
+	db.base = &diskLayer{root: root, db: db}
+	db.layers = make(map[common.Hash]*diffLayer)
+	db.head = root
+}
+
+// layersSize returns the storage size of all the diff layers.
+//
+// Note, this method assumes the database lock is held by the caller.
+func (db *TrieDB) layersSize() common.StorageSize {
+	var size common.StorageSize
+	for _, dl := range db.layers {
+		size += dl.size
+	}
+	return size
+}
@@ -0,0 +1,99 @@
+package trie
+
+import (
+	"sync"
+
+	"github.com/jaiminpan/mt-trie/accdb"
+	"github.com/jaiminpan/mt-trie/common"
+)
+
+// preimagePrefix + hash -> preimage
+var preimagePrefix = []byte("secure-key-")
+
+// preimageKey = preimagePrefix + hash
+func preimageKey(hash common.Hash) []byte {
+	return append(append([]byte{}, preimagePrefix...), hash[:]...)
+}
+
+// preimageStore is the store for caching preimages of node key.
+type preimageStore struct {
+	lock          sync.RWMutex
+	disk          accdb.KeyValueStore
+	preimages     map[common.Hash][]byte // Preimages of nodes from the secure trie
+	preimagesSize common.StorageSize     // Storage size of the preimages cache
+}
+
+// newPreimageStore initializes the store for caching preimages.
+func newPreimageStore(disk accdb.KeyValueStore) *preimageStore {
+	return &preimageStore{
+		disk:      disk,
+		preimages: make(map[common.Hash][]byte),
+	}
+}
+
+// insertPreimage writes a new trie node pre-image to the memory database if it's
+// yet unknown. The method will NOT make a copy of the slice, only use if the
+// preimage will NOT be changed later on.
+func (store *preimageStore) insertPreimage(preimages map[common.Hash][]byte) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for hash, preimage := range preimages {
+		if _, ok := store.preimages[hash]; ok {
+			continue
+		}
+		store.preimages[hash] = preimage
+		store.preimagesSize += common.StorageSize(common.HashLength + len(preimage))
+	}
+}
+
+// preimage retrieves a cached trie node pre-image from memory. If it cannot be
+// found cached, the method queries the persistent database for the content.
+func (store *preimageStore) preimage(hash common.Hash) []byte {
+	store.lock.RLock()
+	preimage := store.preimages[hash]
+	store.lock.RUnlock()
+
+	if preimage != nil {
+		return preimage
+	}
+	preimage, _ = store.disk.Get(preimageKey(hash))
+	return preimage
+}
+
+// commit flushes the cached preimages into the disk. If force is false,
+// the preimages are only flushed once the cache grows beyond the ideal
+// batch size.
+func (store *preimageStore) commit(force bool) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.preimagesSize <= accdb.IdealBatchSize && !force {
+		return nil
+	}
+	batch := store.disk.NewBatch()
+	for hash, preimage := range store.preimages {
+		if err := batch.Put(preimageKey(hash), preimage); err != nil {
+			return err
+		}
+		if batch.ValueSize() >= accdb.IdealBatchSize {
+			if err := batch.Submit(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := batch.Submit(); err != nil {
+		return err
+	}
+	store.preimages, store.preimagesSize = make(map[common.Hash][]byte), 0
+	return nil
+}
+
+// size returns the current storage size of accumulated preimages.
+func (store *preimageStore) size() common.StorageSize {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.preimagesSize
+}
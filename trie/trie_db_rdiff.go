@@ -0,0 +1,295 @@
+package trie
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/jaiminpan/mt-trie/accdb"
+	"github.com/jaiminpan/mt-trie/common"
+	"github.com/jaiminpan/mt-trie/rlp"
+)
+
+var (
+	// reverseDiffPrefix + id (uint64 big endian) -> rlp-encoded reverse diff
+	reverseDiffPrefix = []byte("r")
+
+	// reverseDiffHeadKey tracks the identifier of the most recent reverse diff.
+	reverseDiffHeadKey = []byte("ReverseDiffHead")
+
+	// reverseDiffRootKey tracks the most recent state root, the reverse diffs
+	// are applied backwards from it.
+	reverseDiffRootKey = []byte("ReverseDiffRoot")
+)
+
+// defaultReverseDiffs is the number of the most recent reverse diffs retained
+// for rollback if it's not configured otherwise.
+const defaultReverseDiffs = 128
+
+// reverseDiffKey = reverseDiffPrefix + id (uint64 big endian)
+func reverseDiffKey(id uint64) []byte {
+	key := make([]byte, len(reverseDiffPrefix)+8)
+	copy(key, reverseDiffPrefix)
+	binary.BigEndian.PutUint64(key[len(reverseDiffPrefix):], id)
+	return key
+}
+
+// reverseDiffNode is the previous value of a trie node touched by an update.
+type reverseDiffNode struct {
+	Owner common.Hash // Identifier of the trie the node belongs to
+	Path  []byte      // Path of the node inside the trie
+	Prev  []byte      // RLP-encoded previous value, empty means it was non-existent
+}
+
+// reverseDiff is the reverse of the node changes made by a single database
+// update. Applying it reverts the database from Root back to Parent.
+type reverseDiff struct {
+	Parent common.Hash       // State root before the update
+	Root   common.Hash       // State root after the update
+	Nodes  []reverseDiffNode // Previous values of all touched nodes
+}
+
+// newReverseDiff constructs the reverse diff of the given node set which
+// transforms the state from parent to root.
+func newReverseDiff(root common.Hash, parent common.Hash, nodes *MergedNodeSet) *reverseDiff {
+	owners := make([]common.Hash, 0, len(nodes.sets))
+	for owner := range nodes.sets {
+		owners = append(owners, owner)
+	}
+	sort.Slice(owners, func(i, j int) bool { return bytes.Compare(owners[i][:], owners[j][:]) < 0 })
+
+	diff := &reverseDiff{Parent: parent, Root: root}
+	for _, owner := range owners {
+		set := nodes.sets[owner]
+		for _, path := range set.updates.order {
+			oldv := set.updates.nodes[path].oldv
+			diff.Nodes = append(diff.Nodes, reverseDiffNode{Owner: owner, Path: []byte(path), Prev: oldv})
+		}
+		set.ForEachDeleted(func(path []byte, oldv []byte) {
+			diff.Nodes = append(diff.Nodes, reverseDiffNode{Owner: owner, Path: path, Prev: oldv})
+		})
+	}
+	return diff
+}
+
+// readReverseDiffHead retrieves the identifier of the most recent reverse
+// diff, 0 is returned if there is none.
+func readReverseDiffHead(db accdb.KeyValueReader) uint64 {
+	blob, _ := db.Get(reverseDiffHeadKey)
+	if len(blob) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(blob)
+}
+
+// readReverseDiffRoot retrieves the most recent state root. The root of the
+// reverse diff with the given identifier is used if it's not tracked yet, the
+// empty root if there is no diff either.
+func readReverseDiffRoot(db accdb.KeyValueReader, head uint64) common.Hash {
+	blob, _ := db.Get(reverseDiffRootKey)
+	if len(blob) == common.HashLength {
+		return common.BytesToHash(blob)
+	}
+	if head == 0 {
+		return emptyRoot
+	}
+	diff, err := readReverseDiff(db, head)
+	if err != nil {
+		return emptyRoot
+	}
+	return diff.Root
+}
+
+// readReverseDiff retrieves the reverse diff with the given identifier.
+func readReverseDiff(db accdb.KeyValueReader, id uint64) (*reverseDiff, error) {
+	blob, _ := db.Get(reverseDiffKey(id))
+	if len(blob) == 0 {
+		return nil, fmt.Errorf("reverse diff %d is not found", id)
+	}
+	var diff reverseDiff
+	if err := rlp.DecodeBytes(blob, &diff); err != nil {
+		return nil, err
+	}
+	return &diff, nil
+}
+
+// writeReverseDiffHead stores the identifier of the most recent reverse diff
+// along with the most recent state root.
+func writeReverseDiffHead(db accdb.KeyValueWriter, id uint64, root common.Hash) error {
+	var enc [8]byte
+	binary.BigEndian.PutUint64(enc[:], id)
+	if err := db.Put(reverseDiffHeadKey, enc[:]); err != nil {
+		return err
+	}
+	return db.Put(reverseDiffRootKey, root[:])
+}
+
+// storeReverseDiff persists the reverse diff of the given node set into the
+// disk database. No diff is stored if the update doesn't change the state.
+// Only the configured number of the most recent diffs is retained, the
+// oldest one is deleted along with the write of the new one.
+//
+// Note, this method assumes the database lock is held by the caller.
+func (db *TrieDB) storeReverseDiff(root common.Hash, parent common.Hash, nodes *MergedNodeSet) error {
+	if root == parent {
+		return nil
+	}
+	blob, err := rlp.EncodeToBytes(newReverseDiff(root, parent, nodes))
+	if err != nil {
+		return err
+	}
+	id := db.diffHead + 1
+
+	batch := db.diskdb.NewBatch()
+	if err := batch.Put(reverseDiffKey(id), blob); err != nil {
+		return err
+	}
+	if err := writeReverseDiffHead(batch, id, root); err != nil {
+		return err
+	}
+	if id > db.diffLimit {
+		if err := batch.Delete(reverseDiffKey(id - db.diffLimit)); err != nil {
+			return err
+		}
+	}
+	if err := batch.Submit(); err != nil {
+		return err
+	}
+	db.diffHead, db.diffRoot = id, root
+	return nil
+}
+
+// Rollback reverts the database to the state of the given root. The reverse
+// diffs of all the updates made on top of the target state are applied from
+// the most recent one backwards: the previous values of the touched nodes
+// are restored on disk, so the target state stays readable even if its nodes
+// have been removed in the meantime, and the dirty nodes of the reverted
+// states are dropped from the memory cache. Rolling back to the most recent
+// state is a noop. Only the ancestors of the most recent state which are
+// covered by the retained reverse diffs can be reached.
+//
+// The reverse diffs are stored in a single sequence, including the diffs of
+// the forks made in the meantime. Only the diffs leading from the most recent
+// state down to the target are applied, the diffs of the other branches are
+// skipped and dropped along with them.
+//
+// In the hash scheme the nodes are shared by the states, so the nodes of the
+// reverted states which are already persisted are left on disk and those
+// states stay readable, only their dirty nodes are dropped.
+//
+// In the path scheme the diff layers of the most recent state are flattened
+// first, then the previous values are written back in place, deleting the
+// nodes which didn't exist. All the diff layers are dropped, the target
+// becomes the disk layer. Nothing is changed if the target can't be reached.
+func (db *TrieDB) Rollback(target common.Hash) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	current := db.diffRoot
+	if db.scheme == PathScheme {
+		current = db.head
+	}
+	if current == target {
+		return nil
+	}
+	// Collect the reverse diffs from the most recent state down to the target
+	// by following the parent states, skipping the diffs of the other branches.
+	var (
+		diffs  []*reverseDiff
+		oldest uint64 // Identifier of the oldest diff to apply
+	)
+	for id, root := db.diffHead, current; root != target; id-- {
+		if id == 0 || db.diffHead-id >= db.diffLimit {
+			return fmt.Errorf("no reverse diff leads to state %x", target)
+		}
+		diff, err := readReverseDiff(db.diskdb, id)
+		if err != nil {
+			return err
+		}
+		if diff.Root != root {
+			continue
+		}
+		diffs = append(diffs, diff)
+		root, oldest = diff.Parent, id
+	}
+	// The target is known to be an ancestor of the most recent state, only
+	// now the layers can be flattened, the diffs apply on top of the disk.
+	if db.scheme == PathScheme {
+		if err := db.capLayers(db.head, 0); err != nil {
+			return err
+		}
+	}
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+
+	batch := db.diskdb.NewBatch()
+	for _, diff := range diffs {
+		for _, n := range diff.Nodes {
+			if db.scheme == PathScheme {
+				var err error
+				if len(n.Prev) == 0 {
+					err = deleteTrieNode(batch, n.Owner, n.Path, PathScheme)
+				} else {
+					err = writeTrieNode(batch, n.Owner, n.Path, common.BytesToHash(h.hashData(n.Prev)), n.Prev, PathScheme)
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if len(n.Prev) == 0 {
+				continue
+			}
+			hash := common.BytesToHash(h.hashData(n.Prev))
+			if _, ok := db.dirties[hash]; ok {
+				continue
+			}
+			if ok, _ := db.diskdb.Has(hash[:]); ok {
+				continue
+			}
+			if err := batch.Put(hash[:], n.Prev); err != nil {
+				return err
+			}
+		}
+		// Drop the reverted state from the dirty cache, the nodes shared
+		// with other states are retained by their reference counts.
+		if diff.Root != target {
+			if _, ok := db.dirties[diff.Root]; ok {
+				db.dereference(diff.Root, common.Hash{})
+			}
+		}
+	}
+	// Drop the applied diffs along with the skipped diffs of other branches
+	for id := oldest; id <= db.diffHead; id++ {
+		if err := batch.Delete(reverseDiffKey(id)); err != nil {
+			return err
+		}
+	}
+	head := oldest - 1
+	if err := writeReverseDiffHead(batch, head, target); err != nil {
+		return err
+	}
+	if db.scheme == PathScheme {
+		if err := batch.Put(diskLayerRootKey, target[:]); err != nil {
+			return err
+		}
+	}
+	if err := batch.Submit(); err != nil {
+		return err
+	}
+	if db.scheme == PathScheme {
+		// Evict the reverted paths from the clean cache, they hold the
+		// versions of the discarded states.
+		if db.cleans != nil {
+			for _, diff := range diffs {
+				for _, n := range diff.Nodes {
+					db.cleans.del(trieNodeKey(n.Owner, n.Path))
+				}
+			}
+		}
+		db.resetLayers(target)
+	}
+	db.diffHead, db.diffRoot = head, target
+	return nil
+}
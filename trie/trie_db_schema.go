@@ -0,0 +1,118 @@
+package trie
+
+import (
+	"bytes"
+
+	"github.com/jaiminpan/mt-trie/accdb"
+	"github.com/jaiminpan/mt-trie/common"
+)
+
+// The list of the supported node storage schemes.
+const (
+	// HashScheme stores every trie node under its hash. Nodes are shared by
+	// all the tries and all the versions referencing them, stale nodes are
+	// never removed from the disk.
+	HashScheme = "hash"
+
+	// PathScheme stores every trie node under the owner of the trie and the
+	// path of the node inside the trie. The nodes of a newer version overwrite
+	// the ones of the older version in place, only the latest version of the
+	// state is available on disk.
+	PathScheme = "path"
+)
+
+var (
+	// trieNodeAccountPrefix + path -> account trie node
+	trieNodeAccountPrefix = []byte("A")
+
+	// trieNodeStoragePrefix + owner + path -> storage trie node
+	trieNodeStoragePrefix = []byte("O")
+)
+
+// accountTrieNodeKey = trieNodeAccountPrefix + path
+func accountTrieNodeKey(path []byte) []byte {
+	return append(append([]byte{}, trieNodeAccountPrefix...), path...)
+}
+
+// storageTrieNodeKey = trieNodeStoragePrefix + owner + path
+func storageTrieNodeKey(owner common.Hash, path []byte) []byte {
+	key := make([]byte, 0, len(trieNodeStoragePrefix)+common.HashLength+len(path))
+	key = append(key, trieNodeStoragePrefix...)
+	key = append(key, owner[:]...)
+	return append(key, path...)
+}
+
+// trieNodeKey returns the path scheme database key of the trie node identified
+// by the owner of the trie and the path of the node.
+func trieNodeKey(owner common.Hash, path []byte) []byte {
+	if owner == (common.Hash{}) {
+		return accountTrieNodeKey(path)
+	}
+	return storageTrieNodeKey(owner, path)
+}
+
+// ResolvePath splits the composite sync path into the owner of the trie and
+// the path of the node inside the trie. The nodes of the account trie have no
+// owner, the storage trie nodes are prefixed with the hexary account hash.
+func ResolvePath(path []byte) (common.Hash, []byte) {
+	var owner common.Hash
+	if len(path) >= 2*common.HashLength {
+		owner = common.BytesToHash(hexToKeybytes(path[:2*common.HashLength]))
+		path = path[2*common.HashLength:]
+	}
+	return owner, path
+}
+
+// readTrieNode retrieves the trie node with the given owner, path and hash
+// from the disk according to the storage scheme. Nil is returned if the node
+// is not found. In the path scheme the node stored under the path is only
+// returned if its hash matches, older or newer versions are ignored.
+func readTrieNode(db accdb.KeyValueReader, owner common.Hash, path []byte, hash common.Hash, scheme string) []byte {
+	if scheme != PathScheme {
+		blob, _ := db.Get(hash[:])
+		return blob
+	}
+	blob, _ := db.Get(trieNodeKey(owner, path))
+	if len(blob) == 0 || !nodeHashMatches(blob, hash) {
+		return nil
+	}
+	return blob
+}
+
+// nodeHashMatches reports whether the given RLP-encoded trie node has the
+// given hash.
+func nodeHashMatches(blob []byte, hash common.Hash) bool {
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+
+	return bytes.Equal(h.hashData(blob), hash[:])
+}
+
+// hasTrieNode reports whether the trie node with the given owner, path and
+// hash is present in the disk according to the storage scheme.
+func hasTrieNode(db accdb.KeyValueReader, owner common.Hash, path []byte, hash common.Hash, scheme string) bool {
+	if scheme != PathScheme {
+		ok, _ := db.Has(hash[:])
+		return ok
+	}
+	return len(readTrieNode(db, owner, path, hash, scheme)) != 0
+}
+
+// writeTrieNode stores the trie node with the given owner, path and hash into
+// the disk according to the storage scheme.
+func writeTrieNode(db accdb.KeyValueWriter, owner common.Hash, path []byte, hash common.Hash, blob []byte, scheme string) error {
+	if scheme != PathScheme {
+		return db.Put(hash[:], blob)
+	}
+	return db.Put(trieNodeKey(owner, path), blob)
+}
+
+// deleteTrieNode removes the trie node with the given owner and path from the
+// disk according to the storage scheme. The nodes of the hash scheme
+// might be shared, so they are never deleted.
+func deleteTrieNode(db accdb.KeyValueWriter, owner common.Hash, path []byte, scheme string) error {
+	if scheme != PathScheme {
+		return nil
+	}
+	return db.Delete(trieNodeKey(owner, path))
+}
@@ -0,0 +1,537 @@
+package trie
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jaiminpan/mt-trie/accdb/memorydb"
+	"github.com/jaiminpan/mt-trie/common"
+)
+
+// updateTrie inserts the given entries into the trie opened at parent and
+// updates the trie database with the committed nodes without flushing
+// them to disk.
+func updateTrie(t *testing.T, db *TrieDB, parent common.Hash, entries map[string]string) common.Hash {
+	trie, err := New(TrieID(parent), db)
+	if err != nil {
+		t.Fatalf("Failed to open trie %x: %v", parent, err)
+	}
+	for k, v := range entries {
+		trie.Update([]byte(k), []byte(v))
+	}
+	root, nodes, err := trie.Commit(false)
+	if err != nil {
+		t.Fatalf("Failed to commit trie: %v", err)
+	}
+	merged := NewMergedNodeSet()
+	if nodes != nil {
+		merged.Merge(nodes)
+	}
+	if err := db.Update(root, parent, merged); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	return root
+}
+
+// checkTrie ensures the trie of the given root contains the given entries.
+func checkTrie(t *testing.T, db *TrieDB, root common.Hash, entries map[string]string) {
+	trie, err := New(TrieID(root), db)
+	if err != nil {
+		t.Fatalf("Failed to open trie %x: %v", root, err)
+	}
+	for k, v := range entries {
+		have, err := trie.TryGet([]byte(k))
+		if err != nil {
+			t.Fatalf("Failed to retrieve %s from %x: %v", k, root, err)
+		}
+		if !bytes.Equal(have, []byte(v)) {
+			t.Fatalf("Value mismatch for %s in %x: have %s, want %s", k, root, have, v)
+		}
+	}
+}
+
+func TestDereferenceSharedNodes(t *testing.T) {
+	db := NewTrieDB(NewMemoryDatabase())
+
+	base := make(map[string]string)
+	for i := 0; i < 256; i++ {
+		base[string(randBytes(32))] = string(randBytes(40))
+	}
+	root1 := updateTrie(t, db, emptyRoot, base)
+	db.Reference(root1, common.Hash{})
+
+	// The second state only changes a single entry, all the other
+	// subtries are shared with the first state.
+	change := map[string]string{string(randBytes(32)): string(randBytes(40))}
+	root2 := updateTrie(t, db, root1, change)
+	db.Reference(root2, common.Hash{})
+
+	nodes := len(db.Nodes())
+	db.Dereference(root1)
+
+	// The nodes exclusively owned by the first state are gone...
+	if _, ok := db.dirties[root1]; ok {
+		t.Fatal("Dereferenced root is still cached")
+	}
+	if len(db.Nodes()) >= nodes {
+		t.Fatalf("No nodes dropped: before %d, after %d", nodes, len(db.Nodes()))
+	}
+	// ...while the shared ones survive, so the second state is complete.
+	for k, v := range change {
+		base[k] = v
+	}
+	checkTrie(t, db, root2, base)
+
+	db.Dereference(root2)
+	if n := len(db.Nodes()); n != 0 {
+		t.Fatalf("Dirty cache not empty after dropping all roots: %d nodes", n)
+	}
+	if db.oldest != (common.Hash{}) {
+		t.Fatalf("Flush-list not empty: oldest %x", db.oldest)
+	}
+}
+
+func TestDereferenceKeepsRetainedRoots(t *testing.T) {
+	db := NewTrieDB(NewMemoryDatabase())
+
+	// Keep the last two roots in the dirty cache, drop the older ones.
+	var (
+		roots   []common.Hash
+		states  []map[string]string
+		parent  = emptyRoot
+		entries = make(map[string]string)
+	)
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 16; j++ {
+			entries[string(randBytes(32))] = string(randBytes(40))
+		}
+		root := updateTrie(t, db, parent, entries)
+		db.Reference(root, common.Hash{})
+
+		state := make(map[string]string)
+		for k, v := range entries {
+			state[k] = v
+		}
+		roots, states = append(roots, root), append(states, state)
+		if len(roots) > 2 {
+			db.Dereference(roots[len(roots)-3])
+		}
+		parent = root
+	}
+	for i := len(roots) - 2; i < len(roots); i++ {
+		checkTrie(t, db, roots[i], states[i])
+	}
+	// Flushing the head state persists it along with all the shared nodes.
+	if err := db.Commit(roots[len(roots)-1]); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	checkTrie(t, db, roots[len(roots)-1], states[len(states)-1])
+}
+
+func TestCapDirtyCache(t *testing.T) {
+	diskdb := NewMemoryDatabase()
+	db := NewTrieDB(diskdb)
+
+	var (
+		parent  = emptyRoot
+		entries = make(map[string]string)
+	)
+	for i := 0; i < 16; i++ {
+		for j := 0; j < 64; j++ {
+			entries[string(randBytes(32))] = string(randBytes(40))
+		}
+		parent = updateTrie(t, db, parent, entries)
+		db.Reference(parent, common.Hash{})
+	}
+	size := db.Size()
+	if size == 0 {
+		t.Fatal("Dirty cache size not tracked")
+	}
+	// Cap the dirty cache to half of its size, the oldest nodes are flushed.
+	limit := size / 2
+	if err := db.Cap(limit); err != nil {
+		t.Fatalf("Failed to cap: %v", err)
+	}
+	if have := db.Size(); have > limit {
+		t.Fatalf("Dirty cache exceeds the limit: have %v, limit %v", have, limit)
+	}
+	checkTrie(t, db, parent, entries)
+
+	// Capping everything leaves an empty cache, all nodes are served from disk.
+	if err := db.Cap(0); err != nil {
+		t.Fatalf("Failed to cap: %v", err)
+	}
+	if have := db.Size(); have != 0 {
+		t.Fatalf("Dirty cache not empty: %v", have)
+	}
+	if n := len(db.Nodes()); n != 0 {
+		t.Fatalf("Dirty cache not empty: %d nodes", n)
+	}
+	checkTrie(t, NewTrieDB(diskdb), parent, entries)
+
+	// Dereferencing the flushed roots keeps the accounting consistent.
+	db.Dereference(parent)
+	if have := db.Size(); have != 0 {
+		t.Fatalf("Unexpected dirty cache size: %v", have)
+	}
+}
+
+func TestSizeAccounting(t *testing.T) {
+	db := NewTrieDB(NewMemoryDatabase())
+
+	entries := make(map[string]string)
+	for i := 0; i < 128; i++ {
+		entries[string(randBytes(32))] = string(randBytes(40))
+	}
+	root := updateTrie(t, db, emptyRoot, entries)
+	db.Reference(root, common.Hash{})
+	if db.Size() == 0 {
+		t.Fatal("Dirty cache size not tracked")
+	}
+	// Dropping the only root returns the cache to zero.
+	db.Dereference(root)
+	if have := db.Size(); have != 0 {
+		t.Fatalf("Unexpected dirty cache size after dereference: %v", have)
+	}
+	// Committing a root to disk also releases its memory.
+	root = updateTrie(t, db, emptyRoot, entries)
+	if err := db.Commit(root); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if have := db.Size(); have != 0 {
+		t.Fatalf("Unexpected dirty cache size after commit: %v", have)
+	}
+}
+
+func TestCleanCache(t *testing.T) {
+	diskdb := NewMemoryDatabase()
+	db := NewTrieDBWithConfig(diskdb, &Config{Cache: 1})
+
+	entries := make(map[string]string)
+	for i := 0; i < 256; i++ {
+		entries[string(randBytes(32))] = string(randBytes(40))
+	}
+	root := updateTrie(t, db, emptyRoot, entries)
+	if err := db.Commit(root); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	// The committed nodes are moved into the clean cache, so the reads
+	// are served from memory.
+	hits, misses := db.CleanCacheStats()
+	if hits != 0 || misses != 0 {
+		t.Fatalf("Unexpected initial stats: hits %d, misses %d", hits, misses)
+	}
+	checkTrie(t, db, root, entries)
+	if hits, _ = db.CleanCacheStats(); hits == 0 {
+		t.Fatal("No clean cache hits after commit")
+	}
+	// A fresh database populates the cache on the first read.
+	db = NewTrieDBWithConfig(diskdb, &Config{Cache: 1})
+	checkTrie(t, db, root, entries)
+	_, misses = db.CleanCacheStats()
+	if misses == 0 {
+		t.Fatal("No clean cache misses on cold reads")
+	}
+	checkTrie(t, db, root, entries)
+	if _, have := db.CleanCacheStats(); have != misses {
+		t.Fatalf("Warm reads missed the clean cache: have %d misses, want %d", have, misses)
+	}
+}
+
+func TestCleanCacheEviction(t *testing.T) {
+	cache := newCleanCache(3 * (common.HashLength + 10))
+
+	var keys [][]byte
+	for i := 0; i < 4; i++ {
+		key := randBytes(32)
+		keys = append(keys, key)
+		cache.set(key, randBytes(10))
+		if i == 2 {
+			cache.get(keys[0]) // Promote the first entry
+		}
+	}
+	if cache.get(keys[1]) != nil {
+		t.Fatal("Least recently used entry not evicted")
+	}
+	for _, i := range []int{0, 2, 3} {
+		if cache.get(keys[i]) == nil {
+			t.Fatalf("Entry %d evicted", i)
+		}
+	}
+	// Overwriting an entry replaces the cached blob, deleting drops it.
+	blob := randBytes(10)
+	cache.set(keys[2], blob)
+	if !bytes.Equal(cache.get(keys[2]), blob) {
+		t.Fatal("Overwritten entry not replaced")
+	}
+	cache.del(keys[2])
+	if cache.get(keys[2]) != nil {
+		t.Fatal("Deleted entry still cached")
+	}
+	// Oversized blobs are never cached.
+	large := randBytes(32)
+	cache.set(large, randBytes(4*(common.HashLength+10)))
+	if cache.get(large) != nil {
+		t.Fatal("Oversized blob cached")
+	}
+}
+
+func TestPathScheme(t *testing.T)           { testPathScheme(t, 0) }
+func TestPathSchemeCleanCache(t *testing.T) { testPathScheme(t, 16) }
+
+func testPathScheme(t *testing.T, cache int) {
+	diskdb := NewMemoryDatabase()
+	db := NewTrieDBWithConfig(diskdb, &Config{Scheme: PathScheme, Cache: cache})
+
+	// Overwrite the same set of keys in every version, the older versions
+	// are replaced on disk.
+	var (
+		roots  []common.Hash
+		states []map[string]string
+		parent = emptyRoot
+		keys   [][]byte
+	)
+	for i := 0; i < 32; i++ {
+		keys = append(keys, randBytes(32))
+	}
+	for i := 0; i < 4; i++ {
+		entries := make(map[string]string)
+		for _, key := range keys {
+			entries[string(key)] = string(randBytes(40))
+		}
+		root := updateTrie(t, db, parent, entries)
+		checkTrie(t, db, root, entries)
+		if err := db.Commit(root); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+		if size := db.Size(); size != 0 {
+			t.Fatalf("Dirty nodes left after commit: %v", size)
+		}
+		roots, states = append(roots, root), append(states, entries)
+		parent = root
+	}
+	checkTrie(t, db, roots[3], states[3])
+	if _, err := New(TrieID(roots[2]), db); err == nil {
+		t.Fatal("Expected overwritten state to be unavailable")
+	}
+	// Only the nodes of the latest version are left, next to the reverse
+	// diffs, their head marker and root and the persisted state root.
+	var count int
+	for it := mustOpen(t, db, roots[3]).NodeIterator(nil); it.Next(true); {
+		if it.Hash() != (common.Hash{}) {
+			count++
+		}
+	}
+	if have, want := diskdb.(*memorydb.MemDB).Len(), count+len(roots)+3; have != want {
+		t.Fatalf("Unexpected database entries: have %d, want %d", have, want)
+	}
+	// The nodes are readable from a fresh database, rolling back restores the
+	// older version in place.
+	db = NewTrieDBWithConfig(diskdb, &Config{Scheme: PathScheme, Cache: cache})
+	checkTrie(t, db, roots[3], states[3])
+	if err := db.Rollback(roots[1]); err != nil {
+		t.Fatalf("Failed to rollback: %v", err)
+	}
+	checkTrie(t, db, roots[1], states[1])
+	if _, err := New(TrieID(roots[3]), db); err == nil {
+		t.Fatal("Expected reverted state to be unavailable")
+	}
+}
+
+func TestDiffLayers(t *testing.T)           { testDiffLayers(t, 0) }
+func TestDiffLayersCleanCache(t *testing.T) { testDiffLayers(t, 16) }
+
+func testDiffLayers(t *testing.T, cache int) {
+	diskdb := NewMemoryDatabase()
+	db := NewTrieDBWithConfig(diskdb, &Config{Scheme: PathScheme, DiffLayers: 4, Cache: cache})
+
+	var (
+		roots   []common.Hash
+		states  []map[string]string
+		entries = make(map[string]string)
+	)
+	update := func(parent common.Hash, state map[string]string) (common.Hash, map[string]string) {
+		next := make(map[string]string)
+		for k, v := range state {
+			next[k] = v
+		}
+		for i := 0; i < 16; i++ {
+			next[string(randBytes(32))] = string(randBytes(40))
+		}
+		return updateTrie(t, db, parent, next), next
+	}
+	parent := emptyRoot
+	for i := 0; i < 8; i++ {
+		root, state := update(parent, entries)
+		roots, states = append(roots, root), append(states, state)
+		parent, entries = root, state
+	}
+	// The four most recent versions are kept in memory on top of the
+	// flattened disk layer, the older ones are overwritten.
+	if len(db.layers) != 4 || db.base.root != roots[3] {
+		t.Fatalf("Unexpected layers: %d diffs, disk %x", len(db.layers), db.base.root)
+	}
+	if root := readDiskLayerRoot(diskdb); root != roots[3] {
+		t.Fatalf("Unexpected persisted root: have %x, want %x", root, roots[3])
+	}
+	for i := 3; i < 8; i++ {
+		checkTrie(t, db, roots[i], states[i])
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := New(TrieID(roots[i]), db); err == nil {
+			t.Fatalf("Expected flattened state %d to be unavailable", i)
+		}
+	}
+	// Fork off a middle version, it's available until its parent is flattened.
+	fork, forkState := update(roots[5], states[5])
+	checkTrie(t, db, fork, forkState)
+	for i := 8; i < 10; i++ {
+		root, state := update(roots[i-1], states[i-1])
+		roots, states = append(roots, root), append(states, state)
+	}
+	checkTrie(t, db, fork, forkState)
+
+	root, state := update(roots[9], states[9])
+	roots, states = append(roots, root), append(states, state)
+	if _, ok := db.layers[fork]; ok {
+		t.Fatal("Stale fork is still cached")
+	}
+	for i := 6; i < 11; i++ {
+		checkTrie(t, db, roots[i], states[i])
+	}
+	// Committing the head flattens all the layers into the disk.
+	if db.Size() == 0 {
+		t.Fatal("Expected diff layers to be accounted")
+	}
+	if err := db.Commit(roots[10]); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if len(db.layers) != 0 || db.Size() != 0 {
+		t.Fatalf("Diff layers left after commit: %d", len(db.layers))
+	}
+	checkTrie(t, NewTrieDBWithConfig(diskdb, &Config{Scheme: PathScheme, Cache: cache}), roots[10], states[10])
+}
+
+func TestDiffLayersOverwrittenCleanNodes(t *testing.T) {
+	diskdb := NewMemoryDatabase()
+	db := NewTrieDBWithConfig(diskdb, &Config{Scheme: PathScheme, DiffLayers: 1, Cache: 16})
+
+	var keys [][]byte
+	for i := 0; i < 16; i++ {
+		keys = append(keys, randBytes(32))
+	}
+	update := func(parent common.Hash) (common.Hash, map[string]string) {
+		entries := make(map[string]string)
+		for _, key := range keys {
+			entries[string(key)] = string(randBytes(40))
+		}
+		return updateTrie(t, db, parent, entries), entries
+	}
+	root0, state0 := update(emptyRoot)
+	root1, state1 := update(root0)
+
+	// The first version is flattened into the disk, reading it fills the
+	// clean cache with its nodes.
+	checkTrie(t, db, root0, state0)
+
+	// Flattening the second version overwrites the cached paths, the first
+	// version must not be served from the clean cache anymore.
+	root2, state2 := update(root1)
+	if db.base.root != root1 {
+		t.Fatalf("Unexpected disk layer: have %x, want %x", db.base.root, root1)
+	}
+	if _, err := New(TrieID(root0), db); err == nil {
+		t.Fatal("Expected overwritten state to be unavailable")
+	}
+	checkTrie(t, db, root1, state1)
+	checkTrie(t, db, root2, state2)
+}
+
+func TestDiffLayersForkRollback(t *testing.T) {
+	diskdb := NewMemoryDatabase()
+	db := NewTrieDBWithConfig(diskdb, &Config{Scheme: PathScheme})
+
+	base := map[string]string{string(randBytes(32)): string(randBytes(40))}
+	baseRoot := updateTrie(t, db, emptyRoot, base)
+	if err := db.Commit(baseRoot); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	extend := func(parent common.Hash, state map[string]string) (common.Hash, map[string]string) {
+		next := map[string]string{string(randBytes(32)): string(randBytes(40))}
+		for k, v := range state {
+			next[k] = v
+		}
+		return updateTrie(t, db, parent, next), next
+	}
+	// Fork the base state into the branches A -> A2 and B
+	rootA, stateA := extend(baseRoot, base)
+	rootA2, stateA2 := extend(rootA, stateA)
+	rootB, stateB := extend(baseRoot, base)
+
+	// Updating a known state neither creates a layer nor a reverse diff
+	head := db.diffHead
+	updateTrie(t, db, rootA, stateA2)
+	if db.diffHead != head {
+		t.Fatalf("Reverse diff stored for a known state: head %d, want %d", db.diffHead, head)
+	}
+	checkTrie(t, db, rootA2, stateA2)
+	checkTrie(t, db, rootB, stateB)
+
+	// The state A is on another branch than the most recent state B, the
+	// rejected rollback leaves all the branches intact.
+	if err := db.Rollback(rootA); err == nil {
+		t.Fatal("Expected error rolling back to another branch")
+	}
+	if len(db.layers) != 3 || db.base.root != baseRoot {
+		t.Fatalf("Layers changed by rejected rollback: %d diffs, disk %x", len(db.layers), db.base.root)
+	}
+	checkTrie(t, db, rootA, stateA)
+	checkTrie(t, db, rootA2, stateA2)
+	checkTrie(t, db, rootB, stateB)
+
+	// The common ancestor is reachable
+	if err := db.Rollback(baseRoot); err != nil {
+		t.Fatalf("Failed to rollback: %v", err)
+	}
+	checkTrie(t, db, baseRoot, base)
+}
+
+func TestDiffLayersForkAncestorRollback(t *testing.T) {
+	diskdb := NewMemoryDatabase()
+	db := NewTrieDBWithConfig(diskdb, &Config{Scheme: PathScheme})
+
+	base := map[string]string{string(randBytes(32)): string(randBytes(40))}
+	baseRoot := updateTrie(t, db, emptyRoot, base)
+	if err := db.Commit(baseRoot); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	extend := func(parent common.Hash, state map[string]string) (common.Hash, map[string]string) {
+		next := map[string]string{string(randBytes(32)): string(randBytes(40))}
+		for k, v := range state {
+			next[k] = v
+		}
+		return updateTrie(t, db, parent, next), next
+	}
+	// Build base -> X -> C with the sibling X -> B created in between, the
+	// diff of B sits between the diffs of the branch of C.
+	rootX, stateX := extend(baseRoot, base)
+	rootB, _ := extend(rootX, stateX)
+	rootC, _ := extend(rootX, stateX)
+
+	if err := db.Rollback(baseRoot); err != nil {
+		t.Fatalf("Failed to rollback to an ancestor: %v", err)
+	}
+	checkTrie(t, db, baseRoot, base)
+	for _, root := range []common.Hash{rootX, rootB, rootC} {
+		if _, err := New(TrieID(root), db); err == nil {
+			t.Fatalf("Expected reverted state %x to be unavailable", root)
+		}
+	}
+	// All the diffs are dropped, including the one of the sibling B
+	if db.diffHead != 1 {
+		t.Fatalf("Unexpected reverse diff head: %d", db.diffHead)
+	}
+	if err := db.Rollback(rootB); err == nil {
+		t.Fatal("Expected error rolling back to a dropped sibling")
+	}
+}
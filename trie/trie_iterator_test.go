@@ -0,0 +1,314 @@
+package trie
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jaiminpan/mt-trie/common"
+)
+
+func TestEmptyIterator(t *testing.T) {
+	trie := NewEmpty(NewTrieDB(NewMemoryDatabase()))
+	iter := trie.NodeIterator(nil)
+
+	seen := make(map[string]struct{})
+	for iter.Next(true) {
+		seen[string(iter.Path())] = struct{}{}
+	}
+	if len(seen) != 0 {
+		t.Fatal("Unexpected trie node iterated")
+	}
+}
+
+func TestNodeIteratorLeaves(t *testing.T) {
+	trie, vals := randomTrie(1000)
+
+	found := make(map[string][]byte)
+	var prev []byte
+	it := trie.NodeIterator(nil)
+	for it.Next(true) {
+		if !it.Leaf() {
+			continue
+		}
+		if prev != nil && bytes.Compare(prev, it.LeafKey()) >= 0 {
+			t.Fatalf("leaves out of order: %x >= %x", prev, it.LeafKey())
+		}
+		prev = common.CopyBytes(it.LeafKey())
+		found[string(it.LeafKey())] = common.CopyBytes(it.LeafBlob())
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != len(vals) {
+		t.Fatalf("leaf count mismatch: have %d, want %d", len(found), len(vals))
+	}
+	for k, kv := range vals {
+		if !bytes.Equal(found[k], kv.v) {
+			t.Errorf("entry %x: have %x, want %x", kv.k, found[k], kv.v)
+		}
+	}
+}
+
+func TestNodeIteratorCoverage(t *testing.T) {
+	trie, _ := randomTrie(1000)
+	triedb := trie.reader
+	root := commitTrie(trie, emptyRoot)
+
+	// Gather all the node hashes found by the iterator, resolving
+	// the committed nodes lazily from the database.
+	trie, _ = New(TrieID(root), triedb)
+	hashes := make(map[common.Hash]struct{})
+	for it := trie.NodeIterator(nil); it.Next(true); {
+		if it.Hash() != (common.Hash{}) {
+			hashes[it.Hash()] = struct{}{}
+			if blob := it.NodeBlob(); len(blob) == 0 {
+				t.Errorf("missing blob for node %x", it.Hash())
+			}
+		}
+	}
+	// Cross check the hashes and the database itself
+	for hash := range hashes {
+		if _, err := triedb.diskdb.Get(hash[:]); err != nil {
+			t.Errorf("failed to retrieve reported node %x: %v", hash, err)
+		}
+	}
+	// Only the hash-keyed entries of the database are trie nodes
+	var stored int
+	dbit := triedb.diskdb.NewIterator(nil, nil)
+	for dbit.Next() {
+		if len(dbit.Key()) == common.HashLength {
+			stored++
+		}
+	}
+	dbit.Release()
+	if len(hashes) != stored {
+		t.Errorf("node count mismatch: iterated %d, stored %d", len(hashes), stored)
+	}
+}
+
+func TestNodeIteratorSkipChildren(t *testing.T) {
+	trie, _ := randomTrie(100)
+
+	// Skipping the children of the root terminates the iteration.
+	it := trie.NodeIterator(nil)
+	if !it.Next(true) {
+		t.Fatal("missing root node")
+	}
+	if it.Next(false) {
+		t.Fatalf("unexpected node at path %x after skipping root children", it.Path())
+	}
+}
+
+func TestNodeIteratorMissingNode(t *testing.T) {
+	trie, _ := randomTrie(100)
+	triedb := trie.reader
+	root := commitTrie(trie, emptyRoot)
+
+	// Wipe the disk database, the lazy resolution must fail.
+	triedb.diskdb = NewMemoryDatabase()
+	trie = &Trie{root: hashNode(root[:]), reader: triedb}
+
+	it := trie.NodeIterator(nil)
+	for it.Next(true) {
+	}
+	if _, ok := it.Error().(*MissingNodeError); !ok {
+		t.Fatalf("expected missing node error, got %v", it.Error())
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	trie := NewEmpty(NewTrieDB(NewMemoryDatabase()))
+	for _, key := range []string{"aaa", "aab", "abc", "baa", "bcd", "cab"} {
+		trie.Update([]byte(key), []byte("v-"+key))
+	}
+	tests := []struct {
+		start string
+		want  []string
+	}{
+		{"", []string{"aaa", "aab", "abc", "baa", "bcd", "cab"}},
+		{"aab", []string{"aab", "abc", "baa", "bcd", "cab"}},
+		{"abd", []string{"baa", "bcd", "cab"}},
+		{"bc", []string{"bcd", "cab"}},
+		{"d", nil},
+	}
+	it := trie.Iterator(nil)
+	for i, test := range tests {
+		it.Seek([]byte(test.start))
+
+		var have []string
+		for it.Next() {
+			have = append(have, string(it.Key))
+			if want := "v-" + string(it.Key); string(it.Value) != want {
+				t.Errorf("test %d: value mismatch: have %s, want %s", i, it.Value, want)
+			}
+		}
+		if it.Err != nil {
+			t.Fatalf("test %d: iteration failed: %v", i, it.Err)
+		}
+		if !equalKeys(have, test.want) {
+			t.Errorf("test %d: keys mismatch: have %v, want %v", i, have, test.want)
+		}
+	}
+}
+
+func TestPrefixIterator(t *testing.T) {
+	trie, _ := randomTrie(100)
+	for _, key := range []string{"user/alice", "user/bob", "user/carol", "users", "usex", "admin/root"} {
+		trie.Update([]byte(key), []byte(key))
+	}
+	triedb := trie.reader
+	root := commitTrie(trie, emptyRoot)
+	trie, _ = New(TrieID(root), triedb)
+
+	tests := []struct {
+		prefix string
+		seek   string
+		want   []string
+	}{
+		{"user/", "", []string{"user/alice", "user/bob", "user/carol"}},
+		{"user/", "user/b", []string{"user/bob", "user/carol"}},
+		{"user/", "user/d", nil},
+		{"user", "a", []string{"user/alice", "user/bob", "user/carol", "users"}},
+		{"admin/", "", []string{"admin/root"}},
+		{"nobody", "", nil},
+	}
+	for i, test := range tests {
+		it := trie.PrefixIterator([]byte(test.prefix))
+		if test.seek != "" {
+			it.Seek([]byte(test.seek))
+		}
+		var have []string
+		for it.Next() {
+			have = append(have, string(it.Key))
+		}
+		if it.Err != nil {
+			t.Fatalf("test %d: iteration failed: %v", i, it.Err)
+		}
+		if !equalKeys(have, test.want) {
+			t.Errorf("test %d: keys mismatch: have %v, want %v", i, have, test.want)
+		}
+	}
+}
+
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+var testdata1 = []struct{ k, v string }{
+	{"barb", "ba"},
+	{"bard", "bc"},
+	{"bars", "bb"},
+	{"bar", "b"},
+	{"fab", "z"},
+	{"food", "ab"},
+	{"foos", "aa"},
+	{"foo", "a"},
+}
+
+var testdata2 = []struct{ k, v string }{
+	{"aardvark", "c"},
+	{"bar", "b"},
+	{"barb", "bd"},
+	{"bars", "be"},
+	{"fab", "z"},
+	{"foo", "a"},
+	{"foos", "aa"},
+	{"food", "ab"},
+	{"jars", "d"},
+}
+
+func TestDifferenceIterator(t *testing.T) {
+	triedb := NewTrieDB(NewMemoryDatabase())
+	triea := NewEmpty(triedb)
+	for _, val := range testdata1 {
+		triea.Update([]byte(val.k), []byte(val.v))
+	}
+	rootA := commitTrie(triea, emptyRoot)
+	triea, _ = New(TrieID(rootA), triedb)
+
+	trieb := NewEmpty(triedb)
+	for _, val := range testdata2 {
+		trieb.Update([]byte(val.k), []byte(val.v))
+	}
+	rootB := commitTrie(trieb, emptyRoot)
+	trieb, _ = New(TrieID(rootB), triedb)
+
+	found := make(map[string]string)
+	di, _ := NewDifferenceIterator(triea.NodeIterator(nil), trieb.NodeIterator(nil))
+	it := NewIterator(di)
+	for it.Next() {
+		found[string(it.Key)] = string(it.Value)
+	}
+
+	all := []struct{ k, v string }{
+		{"aardvark", "c"},
+		{"barb", "bd"},
+		{"bars", "be"},
+		{"jars", "d"},
+	}
+	for _, item := range all {
+		if found[item.k] != item.v {
+			t.Errorf("iterator value mismatch for %s: got %v want %v", item.k, found[item.k], item.v)
+		}
+	}
+	if len(found) != len(all) {
+		t.Errorf("iterator count mismatch: got %d values, want %d", len(found), len(all))
+	}
+}
+
+func TestUnionIterator(t *testing.T) {
+	triedb := NewTrieDB(NewMemoryDatabase())
+	triea := NewEmpty(triedb)
+	for _, val := range testdata1 {
+		triea.Update([]byte(val.k), []byte(val.v))
+	}
+	rootA := commitTrie(triea, emptyRoot)
+	triea, _ = New(TrieID(rootA), triedb)
+
+	trieb := NewEmpty(triedb)
+	for _, val := range testdata2 {
+		trieb.Update([]byte(val.k), []byte(val.v))
+	}
+	rootB := commitTrie(trieb, emptyRoot)
+	trieb, _ = New(TrieID(rootB), triedb)
+
+	di, _ := NewUnionIterator([]NodeIterator{triea.NodeIterator(nil), trieb.NodeIterator(nil)})
+	it := NewIterator(di)
+
+	all := []struct{ k, v string }{
+		{"aardvark", "c"},
+		{"barb", "ba"},
+		{"barb", "bd"},
+		{"bard", "bc"},
+		{"bars", "bb"},
+		{"bars", "be"},
+		{"bar", "b"},
+		{"fab", "z"},
+		{"food", "ab"},
+		{"foos", "aa"},
+		{"foo", "a"},
+		{"jars", "d"},
+	}
+	for i, kv := range all {
+		if !it.Next() {
+			t.Errorf("Iterator ends prematurely at element %d", i)
+		}
+		if kv.k != string(it.Key) {
+			t.Errorf("iterator value mismatch for element %d: got key %s want %s", i, it.Key, kv.k)
+		}
+		if kv.v != string(it.Value) {
+			t.Errorf("iterator value mismatch for element %d: got value %s want %s", i, it.Value, kv.v)
+		}
+	}
+	if it.Next() {
+		t.Errorf("Iterator returned extra values.")
+	}
+}
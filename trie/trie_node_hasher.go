@@ -27,9 +27,9 @@ var hasherPool = sync.Pool{
 	},
 }
 
-func newHasher() *hasher {
+func newHasher(parallel bool) *hasher {
 	h := hasherPool.Get().(*hasher)
-	h.parallel = false
+	h.parallel = parallel
 	return h
 }
 
@@ -98,7 +98,7 @@ func (h *hasher) hashFullNodeChildren(n *fullNode) (collapsed, cached *fullNode)
 		wg.Add(16)
 		for i := 0; i < 16; i++ {
 			go func(i int) {
-				hasher := newHasher()
+				hasher := newHasher(false)
 				if child := n.Children[i]; child != nil {
 					collapsed.Children[i], cached.Children[i] = hasher.hash(child, false)
 				} else {
@@ -127,9 +127,7 @@ func (h *hasher) hashFullNodeChildren(n *fullNode) (collapsed, cached *fullNode)
 // If the rlp data is smaller than 32 bytes, `nil` is returned.
 func (h *hasher) shortnodeToHash(n *shortNode, force bool) node {
 	n.encode(h.encbuf)
-	h.tmp = h.encbuf.AppendToBytes(h.tmp[:0])
-	h.encbuf.Reset(nil)
-	enc := h.tmp
+	enc := h.encodedBytes()
 
 	if len(enc) < 32 && !force {
 		return n // Nodes smaller than 32 bytes are stored inside their parent
@@ -144,9 +142,7 @@ func (h *hasher) shortnodeToHash(n *shortNode, force bool) node {
 // may contain nil values)
 func (h *hasher) fullnodeToHash(n *fullNode, force bool) node {
 	n.encode(h.encbuf)
-	h.tmp = h.encbuf.AppendToBytes(h.tmp[:0])
-	h.encbuf.Reset(nil)
-	enc := h.tmp
+	enc := h.encodedBytes()
 
 	if len(enc) < 32 && !force {
 		return n // Nodes smaller than 32 bytes are stored inside their parent
@@ -156,3 +152,44 @@ func (h *hasher) fullnodeToHash(n *fullNode, force bool) node {
 	crypto.HashData(h.sha, enc, hashed)
 	return hashed
 }
+
+// encodedBytes returns the result of the last encoding operation on h.encbuf.
+// This also resets the encoder buffer.
+//
+// All node encoding must be done like this:
+//
+//	node.encode(h.encbuf)
+//	enc := h.encodedBytes()
+//
+// This convention exists because node.encode can only be inlined/escape-analyzed when
+// called on a concrete receiver type.
+func (h *hasher) encodedBytes() []byte {
+	h.tmp = h.encbuf.AppendToBytes(h.tmp[:0])
+	h.encbuf.Reset(nil)
+	return h.tmp
+}
+
+// hashData hashes the provided data
+func (h *hasher) hashData(data []byte) hashNode {
+	n := make(hashNode, 32)
+	crypto.HashData(h.sha, data, n)
+	return n
+}
+
+// proofHash is used to construct trie proofs, and returns the 'collapsed'
+// node (for later RLP encoding) as well as the hashed node -- unless the
+// node is smaller than 32 bytes, in which case it will be returned as is.
+// This method does not do anything on value- or hash-nodes.
+func (h *hasher) proofHash(original node) (collapsed, hashed node) {
+	switch n := original.(type) {
+	case *shortNode:
+		sn, _ := h.hashShortNodeChildren(n)
+		return sn, h.shortnodeToHash(sn, false)
+	case *fullNode:
+		fn, _ := h.hashFullNodeChildren(n)
+		return fn, h.fullnodeToHash(fn, false)
+	default:
+		// Value and hash nodes don't have children so they're left as were
+		return n, n
+	}
+}
@@ -2,6 +2,7 @@ package trie
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/jaiminpan/mt-trie/common"
 )
@@ -20,6 +21,15 @@ type memoryNode struct {
 	node node        // Cached collapsed trie node, or raw rlp data, nil for deleted nodes
 }
 
+// rlp returns the raw rlp encoded blob of the cached trie node, either directly
+// from the cache, or by regenerating it from the collapsed node.
+func (n *memoryNode) rlp() []byte {
+	if node, ok := n.node.(rawNode); ok {
+		return node
+	}
+	return nodeToBytes(n.node)
+}
+
 // nodeWithPrev wraps the memoryNode with the previous node value.
 type nodeWithPrev struct {
 	*memoryNode
@@ -71,6 +81,54 @@ func (set *NodeSet) markDeleted(path []byte, oldv []byte) {
 	set.deletes[string(path)] = oldv
 }
 
+// Owner returns the identifier of the trie the set belongs to.
+func (set *NodeSet) Owner() common.Hash {
+	return set.owner
+}
+
+// Size returns the number of updated and deleted nodes contained in the set.
+func (set *NodeSet) Size() (int, int) {
+	return len(set.updates.order), len(set.deletes)
+}
+
+// ForEachUpdated iterates the dirty nodes in the set by insertion order, in
+// which children always precede their parents. The callback receives the node
+// path, the node hash, the rlp-encoded node and the previous value of the node
+// (nil if the node is newly created).
+func (set *NodeSet) ForEachUpdated(callback func(path []byte, hash common.Hash, blob []byte, oldv []byte)) {
+	for _, path := range set.updates.order {
+		n := set.updates.nodes[path]
+		callback([]byte(path), n.hash, n.rlp(), n.oldv)
+	}
+}
+
+// ForEachDeleted iterates the deleted nodes in the set sorted by path. The
+// callback receives the node path and the previous value of the node.
+func (set *NodeSet) ForEachDeleted(callback func(path []byte, oldv []byte)) {
+	paths := make([]string, 0, len(set.deletes))
+	for path := range set.deletes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		callback([]byte(path), set.deletes[path])
+	}
+}
+
+// merge appends all the nodes collected in the other set, which must belong
+// to the same trie, after the nodes already present in set. The insertion
+// order of the other set is retained.
+func (set *NodeSet) merge(other *NodeSet) {
+	for _, path := range other.updates.order {
+		set.updates.order = append(set.updates.order, path)
+		set.updates.nodes[path] = other.updates.nodes[path]
+	}
+	for path, oldv := range other.deletes {
+		set.deletes[path] = oldv
+	}
+	set.leaves = append(set.leaves, other.leaves...)
+}
+
 // addLeaf collects the provided leaf node into set.
 func (set *NodeSet) addLeaf(node *leaf) {
 	set.leaves = append(set.leaves, node)
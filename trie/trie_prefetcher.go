@@ -0,0 +1,219 @@
+package trie
+
+import (
+	"sync"
+
+	"github.com/jaiminpan/mt-trie/common"
+)
+
+// Prefetcher is an active prefetcher, which receives the keys of tries that
+// are about to be accessed and resolves their paths from the database in the
+// background. Every trie is opened afresh and warmed up by a dedicated
+// goroutine, which resolves the scheduled keys one by one in the scheduling
+// order. Only distinct tries (e.g. the account trie and the storage tries)
+// are loaded concurrently, the keys of a single trie are not. Once the caller
+// is ready to process the tries, it can take over the warmed tries, whose
+// nodes along the prefetched paths are already resolved in memory.
+//
+// Note, the prefetcher's API is not thread safe.
+type Prefetcher struct {
+	db       *TrieDB                // Database to load trie nodes through
+	fetchers map[string]*subfetcher // Subfetchers for each trie
+}
+
+// NewPrefetcher creates a prefetcher resolving trie nodes from the given database.
+func NewPrefetcher(db *TrieDB) *Prefetcher {
+	return &Prefetcher{
+		db:       db,
+		fetchers: make(map[string]*subfetcher),
+	}
+}
+
+// Prefetch schedules a batch of trie keys of the identified trie to prefetch.
+// The keys are exactly the ones passed to the trie later on, so for the state
+// tries they must be hashed already.
+func (p *Prefetcher) Prefetch(id *ID, keys [][]byte) {
+	// Active fetcher, schedule the retrievals
+	tid := prefetcherKey(id)
+	fetcher := p.fetchers[tid]
+	if fetcher == nil {
+		fetcher = newSubfetcher(p.db, id)
+		p.fetchers[tid] = fetcher
+	}
+	fetcher.schedule(keys)
+}
+
+// Trie terminates the prefetching of the identified trie and returns the
+// warmed trie, which can be used for the following updates. Nil is returned
+// if the trie was not prefetched or its root can't be resolved. Ownership of
+// the trie passes to the caller, subsequent calls for the same trie return
+// nil until new keys are scheduled.
+func (p *Prefetcher) Trie(id *ID) *Trie {
+	tid := prefetcherKey(id)
+	fetcher := p.fetchers[tid]
+	if fetcher == nil {
+		return nil
+	}
+	delete(p.fetchers, tid)
+
+	// Interrupt the prefetcher and wait until it releases the trie
+	fetcher.abort()
+	return fetcher.trie
+}
+
+// Close terminates all the running subfetchers and discards the warmed tries.
+func (p *Prefetcher) Close() {
+	for tid, fetcher := range p.fetchers {
+		fetcher.abort()
+		delete(p.fetchers, tid)
+	}
+}
+
+// prefetcherKey returns a unique identifier of the trie within the prefetcher.
+func prefetcherKey(id *ID) string {
+	key := make([]byte, 0, 2*common.HashLength)
+	key = append(key, id.Owner[:]...)
+	key = append(key, id.Root[:]...)
+	return string(key)
+}
+
+// subfetcher is a trie fetcher goroutine responsible for pulling entries for a
+// single trie. It is spawned when a new trie is scheduled for prefetching and
+// it resolves the paths of the scheduled keys sequentially until it's
+// interrupted.
+type subfetcher struct {
+	db   *TrieDB // Database to load trie nodes through
+	id   *ID     // Identifier of the trie being populated
+	trie *Trie   // Trie being populated with nodes, nil if the root is missing
+
+	tasks [][]byte   // Items queued up for retrieval
+	busy  bool       // Whether a batch of tasks is being processed
+	done  bool       // Whether the loop is terminated
+	lock  sync.Mutex // Lock protecting the task queue and the flags
+	idle  *sync.Cond // Signals the processed batches and the termination
+
+	wake chan struct{} // Wake channel if a new task is scheduled
+	stop chan struct{} // Channel to interrupt processing
+	term chan struct{} // Channel to signal interruption
+
+	seen map[string]struct{} // Tracks the entries already loaded
+	dups int                 // Number of duplicate preload tasks
+}
+
+// newSubfetcher creates a goroutine to prefetch state items belonging to a
+// particular root hash.
+func newSubfetcher(db *TrieDB, id *ID) *subfetcher {
+	sf := &subfetcher{
+		db:   db,
+		id:   id,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		term: make(chan struct{}),
+		seen: make(map[string]struct{}),
+	}
+	sf.idle = sync.NewCond(&sf.lock)
+	go sf.loop()
+	return sf
+}
+
+// schedule adds a batch of trie keys to the queue to prefetch.
+func (sf *subfetcher) schedule(keys [][]byte) {
+	// Append the tasks to the current queue
+	sf.lock.Lock()
+	sf.tasks = append(sf.tasks, keys...)
+	sf.lock.Unlock()
+
+	// Notify the prefetcher, it's fine if it's already terminated
+	select {
+	case sf.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until all the scheduled tasks are processed or the subfetcher
+// is terminated.
+func (sf *subfetcher) wait() {
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+
+	for !sf.done && (sf.busy || len(sf.tasks) > 0) {
+		sf.idle.Wait()
+	}
+}
+
+// abort interrupts the subfetcher immediately. It is safe to call abort multiple
+// times but it is not thread safe.
+func (sf *subfetcher) abort() {
+	select {
+	case <-sf.stop:
+	default:
+		close(sf.stop)
+	}
+	<-sf.term
+}
+
+// loop waits for new tasks to be scheduled and keeps loading them until it runs
+// out of tasks or its underlying trie is retrieved for committing.
+func (sf *subfetcher) loop() {
+	// No matter how the loop stops, signal anyone waiting that it's terminated
+	defer close(sf.term)
+	defer func() {
+		sf.lock.Lock()
+		sf.done = true
+		sf.idle.Broadcast()
+		sf.lock.Unlock()
+	}()
+
+	// Start by opening the trie and stop processing if it fails
+	trie, err := New(sf.id, sf.db)
+	if err != nil {
+		return
+	}
+	sf.trie = trie
+
+	// Trie opened successfully, keep prefetching items
+	for {
+		select {
+		case <-sf.wake:
+			// Subfetcher was woken up, retrieve any tasks to avoid spinning the lock
+			sf.lock.Lock()
+			tasks := sf.tasks
+			sf.tasks, sf.busy = nil, true
+			sf.lock.Unlock()
+
+			// Prefetch any tasks until the loop is interrupted
+			for i, task := range tasks {
+				select {
+				case <-sf.stop:
+					// If termination is requested, add any leftover back and return
+					sf.lock.Lock()
+					sf.tasks = append(sf.tasks, tasks[i:]...)
+					sf.lock.Unlock()
+					return
+
+				default:
+					// No termination request yet, prefetch the next entry
+					if _, ok := sf.seen[string(task)]; ok {
+						sf.dups++
+					} else {
+						// Errors are ignored, the missing node will be
+						// reported by the synchronous access later on.
+						sf.trie.TryGet(task)
+						sf.seen[string(task)] = struct{}{}
+					}
+				}
+			}
+			// Batch processed, notify the waiters if nothing is queued up
+			sf.lock.Lock()
+			sf.busy = false
+			if len(sf.tasks) == 0 {
+				sf.idle.Broadcast()
+			}
+			sf.lock.Unlock()
+
+		case <-sf.stop:
+			// Termination is requested, abort and leave remaining tasks
+			return
+		}
+	}
+}
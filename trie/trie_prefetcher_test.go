@@ -0,0 +1,93 @@
+package trie
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jaiminpan/mt-trie/accdb"
+	"github.com/jaiminpan/mt-trie/common"
+)
+
+// countingDB is a key-value store counting the disk reads.
+type countingDB struct {
+	accdb.KeyValueStore
+	gets int64
+}
+
+func (db *countingDB) Get(key []byte) ([]byte, error) {
+	atomic.AddInt64(&db.gets, 1)
+	return db.KeyValueStore.Get(key)
+}
+
+func TestPrefetcher(t *testing.T) {
+	diskdb := &countingDB{KeyValueStore: NewMemoryDatabase()}
+	trie, vals := randomTrie(1000)
+	trie.reader = NewTrieDB(diskdb)
+	root := commitTrie(trie, emptyRoot)
+
+	var keys [][]byte
+	for _, kv := range vals {
+		if len(keys) == 100 {
+			break
+		}
+		keys = append(keys, kv.k)
+	}
+	triedb := NewTrieDB(diskdb)
+	prefetcher := NewPrefetcher(triedb)
+	prefetcher.Prefetch(TrieID(root), keys[:50])
+	prefetcher.Prefetch(TrieID(root), keys[50:])
+	prefetcher.Prefetch(TrieID(root), keys[:10]) // Duplicates
+
+	// Wait until the prefetcher processes all the scheduled keys, the trie
+	// is handed over once the prefetcher is interrupted.
+	fetcher := prefetcher.fetchers[prefetcherKey(TrieID(root))]
+	fetcher.wait()
+	warmed := prefetcher.Trie(TrieID(root))
+	if warmed == nil {
+		t.Fatal("Prefetched trie not available")
+	}
+	if prefetcher.Trie(TrieID(root)) != nil {
+		t.Fatal("Prefetched trie handed over twice")
+	}
+	if len(fetcher.seen) != len(keys) || fetcher.dups != 10 {
+		t.Fatalf("Unexpected prefetched keys: %d loaded, %d duplicates", len(fetcher.seen), fetcher.dups)
+	}
+	// All the prefetched paths are served from memory without touching disk.
+	gets := atomic.LoadInt64(&diskdb.gets)
+	for _, key := range keys {
+		if v := warmed.Get(key); !bytes.Equal(v, vals[string(key)].v) {
+			t.Fatalf("Value mismatch for %x: have %x, want %x", key, v, vals[string(key)].v)
+		}
+	}
+	if have := atomic.LoadInt64(&diskdb.gets); have != gets {
+		t.Fatalf("Prefetched paths resolved from disk: %d reads", have-gets)
+	}
+	// The warmed trie can be updated and committed like a regular trie.
+	for _, key := range keys {
+		warmed.Update(key, []byte("updated"))
+	}
+	trie = mustOpen(t, triedb, root)
+	for _, key := range keys {
+		trie.Update(key, []byte("updated"))
+	}
+	if have, want := warmed.Hash(), trie.Hash(); have != want {
+		t.Fatalf("Root mismatch: have %x, want %x", have, want)
+	}
+	prefetcher.Close()
+}
+
+func TestPrefetcherMissingRoot(t *testing.T) {
+	prefetcher := NewPrefetcher(NewTrieDB(NewMemoryDatabase()))
+	defer prefetcher.Close()
+
+	id := TrieID(common.HexToHash("0x01"))
+	prefetcher.Prefetch(id, [][]byte{{0x1}})
+	if trie := prefetcher.Trie(id); trie != nil {
+		t.Fatal("Expected nil trie for missing root")
+	}
+	// Unknown tries are not available either.
+	if trie := prefetcher.Trie(TrieID(common.HexToHash("0x02"))); trie != nil {
+		t.Fatal("Expected nil trie for unscheduled root")
+	}
+}
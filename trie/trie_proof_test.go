@@ -0,0 +1,215 @@
+package trie
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	mrand "math/rand"
+	"sort"
+	"testing"
+
+	"github.com/jaiminpan/mt-trie/accdb/memorydb"
+)
+
+type kv struct {
+	k, v []byte
+}
+
+// randomTrie creates a trie filled with n random 32 byte keys, along with
+// the inserted entries keyed by string(key).
+func randomTrie(n int) (*Trie, map[string]*kv) {
+	trie := NewEmpty(NewTrieDB(NewMemoryDatabase()))
+	vals := make(map[string]*kv)
+	for i := 0; i < n; i++ {
+		value := &kv{randBytes(32), randBytes(20)}
+		trie.Update(value.k, value.v)
+		vals[string(value.k)] = value
+	}
+	return trie, vals
+}
+
+// proofRecorder is a memory database which remembers the keys of all
+// written proof nodes in insertion order.
+type proofRecorder struct {
+	*memorydb.MemDB
+	keys [][]byte
+}
+
+func (r *proofRecorder) Put(key []byte, value []byte) error {
+	r.keys = append(r.keys, key)
+	return r.MemDB.Put(key, value)
+}
+
+// sortedEntries returns the entries of a random trie sorted by key.
+func sortedEntries(vals map[string]*kv) []*kv {
+	var entries []*kv
+	for _, kv := range vals {
+		entries = append(entries, kv)
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].k, entries[j].k) < 0 })
+	return entries
+}
+
+func randBytes(n int) []byte {
+	r := make([]byte, n)
+	crand.Read(r)
+	return r
+}
+
+func TestProof(t *testing.T) {
+	trie, vals := randomTrie(500)
+	root := trie.Hash()
+	for _, kv := range vals {
+		proofs := memorydb.New()
+		if err := trie.Prove(kv.k, proofs); err != nil {
+			t.Fatalf("failed to prove key %x: %v", kv.k, err)
+		}
+		val, err := VerifyProof(root, kv.k, proofs)
+		if err != nil {
+			t.Fatalf("failed to verify proof for key %x: %v", kv.k, err)
+		}
+		if !bytes.Equal(val, kv.v) {
+			t.Fatalf("verified value mismatch for key %x: have %x, want %x", kv.k, val, kv.v)
+		}
+	}
+}
+
+func TestProofFromDatabase(t *testing.T) {
+	trie, vals := randomTrie(200)
+	triedb := trie.reader
+	root := commitTrie(trie, emptyRoot)
+
+	trie, err := New(TrieID(root), triedb)
+	if err != nil {
+		t.Fatalf("failed to reopen trie: %v", err)
+	}
+	for _, kv := range vals {
+		proofs := memorydb.New()
+		if err := trie.Prove(kv.k, proofs); err != nil {
+			t.Fatalf("failed to prove key %x: %v", kv.k, err)
+		}
+		val, err := VerifyProof(root, kv.k, proofs)
+		if err != nil {
+			t.Fatalf("failed to verify proof for key %x: %v", kv.k, err)
+		}
+		if !bytes.Equal(val, kv.v) {
+			t.Fatalf("verified value mismatch for key %x: have %x, want %x", kv.k, val, kv.v)
+		}
+	}
+}
+
+func TestMissingKeyProof(t *testing.T) {
+	trie := NewEmpty(NewTrieDB(NewMemoryDatabase()))
+	trie.Update([]byte("k"), []byte("v"))
+
+	for i, key := range []string{"a", "j", "l", "z"} {
+		proofs := memorydb.New()
+		trie.Prove([]byte(key), proofs)
+
+		if proofs.Len() != 1 {
+			t.Errorf("test %d: proof should have one element", i)
+		}
+		val, err := VerifyProof(trie.Hash(), []byte(key), proofs)
+		if err != nil {
+			t.Fatalf("test %d: failed to verify proof: %v\nraw proof: %x", i, err, proofs)
+		}
+		if val != nil {
+			t.Fatalf("test %d: verified value mismatch: have %x, want nil", i, val)
+		}
+	}
+}
+
+func TestBadProof(t *testing.T) {
+	trie, vals := randomTrie(800)
+	root := trie.Hash()
+	for _, kv := range vals {
+		proofs := &proofRecorder{MemDB: memorydb.New()}
+		if err := trie.Prove(kv.k, proofs); err != nil {
+			t.Fatalf("failed to prove key %x: %v", kv.k, err)
+		}
+		// Drop a random proof node, the verification must fail.
+		keys := proofs.keys
+		if err := proofs.Delete(keys[mrand.Intn(len(keys))]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := VerifyProof(root, kv.k, proofs); err == nil {
+			t.Fatalf("expected proof to fail for key %x", kv.k)
+		}
+	}
+}
+
+func TestRangeProof(t *testing.T) {
+	trie, vals := randomTrie(4096)
+	entries := sortedEntries(vals)
+	root := trie.Hash()
+	for i := 0; i < 500; i++ {
+		start := mrand.Intn(len(entries))
+		end := mrand.Intn(len(entries)-start) + start + 1
+
+		proof := memorydb.New()
+		if err := trie.ProveRange(entries[start].k, entries[end-1].k, proof); err != nil {
+			t.Fatalf("Failed to prove range: %v", err)
+		}
+		var keys, values [][]byte
+		for i := start; i < end; i++ {
+			keys = append(keys, entries[i].k)
+			values = append(values, entries[i].v)
+		}
+		more, err := VerifyRangeProof(root, keys[0], keys, values, proof)
+		if err != nil {
+			t.Fatalf("Case %d(%d->%d) expect no error, got %v", i, start, end-1, err)
+		}
+		if more != (end < len(entries)) {
+			t.Fatalf("Case %d(%d->%d) more flag mismatch, have %v", i, start, end-1, more)
+		}
+	}
+}
+
+func TestAllElementsRangeProof(t *testing.T) {
+	trie, vals := randomTrie(4096)
+	entries := sortedEntries(vals)
+
+	var keys, values [][]byte
+	for _, entry := range entries {
+		keys = append(keys, entry.k)
+		values = append(values, entry.v)
+	}
+	more, err := VerifyRangeProof(trie.Hash(), nil, keys, values, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if more {
+		t.Fatal("Unexpected more flag for the whole leaf set")
+	}
+}
+
+func TestBadRangeProof(t *testing.T) {
+	trie, vals := randomTrie(4096)
+	entries := sortedEntries(vals)
+	root := trie.Hash()
+	for i := 0; i < 500; i++ {
+		start := mrand.Intn(len(entries))
+		end := mrand.Intn(len(entries)-start) + start + 1
+
+		proof := memorydb.New()
+		if err := trie.ProveRange(entries[start].k, entries[end-1].k, proof); err != nil {
+			t.Fatalf("Failed to prove range: %v", err)
+		}
+		var keys, values [][]byte
+		for i := start; i < end; i++ {
+			keys = append(keys, entries[i].k)
+			values = append(values, entries[i].v)
+		}
+		// Corrupt one of the values, or drop an inner element of the range.
+		index := mrand.Intn(len(keys))
+		if len(keys) > 2 && mrand.Intn(2) == 0 {
+			index = mrand.Intn(len(keys)-2) + 1
+			keys = append(keys[:index:index], keys[index+1:]...)
+			values = append(values[:index:index], values[index+1:]...)
+		} else {
+			values[index] = randBytes(20)
+		}
+		if _, err := VerifyRangeProof(root, entries[start].k, keys, values, proof); err == nil {
+			t.Fatalf("Case %d(%d->%d) expected error for bad range", i, start, end-1)
+		}
+	}
+}
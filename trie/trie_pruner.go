@@ -0,0 +1,172 @@
+package trie
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/jaiminpan/mt-trie/accdb"
+	"github.com/jaiminpan/mt-trie/common"
+	"github.com/jaiminpan/mt-trie/rlp"
+	"github.com/jaiminpan/mt-trie/types"
+)
+
+// stateBloomHashes is the number of hash functions used by the state bloom.
+const stateBloomHashes = 4
+
+// stateBloom is a bloom filter of the trie node hashes. The node hashes are
+// uniformly distributed already, so the hash functions simply take different
+// 8 byte windows of them.
+type stateBloom struct {
+	bits []uint64 // Bit vector of the filter
+	size uint64   // Number of bits in the vector
+}
+
+// newStateBloom creates a state bloom with the given size in megabytes.
+func newStateBloom(size uint64) *stateBloom {
+	words := size * 1024 * 1024 / 8
+	if words == 0 {
+		words = 1
+	}
+	return &stateBloom{
+		bits: make([]uint64, words),
+		size: words * 64,
+	}
+}
+
+// add marks the given node hash in the filter.
+func (b *stateBloom) add(hash []byte) {
+	for i := 0; i < stateBloomHashes; i++ {
+		bit := binary.BigEndian.Uint64(hash[i*8:]) % b.size
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// contain reports whether the given node hash might be marked in the filter.
+// False positives are possible, false negatives are not.
+func (b *stateBloom) contain(hash []byte) bool {
+	for i := 0; i < stateBloomHashes; i++ {
+		bit := binary.BigEndian.Uint64(hash[i*8:]) % b.size
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Pruner is an offline tool to delete the stale trie nodes of the hash scheme.
+// All the nodes reachable from the retained state roots are marked in a bloom
+// filter, then every hash-keyed node not marked is deleted from the database.
+// The account leaves are followed into their storage tries. Due to the false
+// positives of the bloom filter a small portion of the stale nodes might be
+// left in the database.
+//
+// The pruning must not run concurrently with any other database access.
+type Pruner struct {
+	db    accdb.KeyValueStore
+	bloom *stateBloom
+}
+
+// NewPruner creates a pruner for the given database with a bloom filter of the
+// given size in megabytes.
+func NewPruner(db accdb.KeyValueStore, bloomSize uint64) *Pruner {
+	return &Pruner{
+		db:    db,
+		bloom: newStateBloom(bloomSize),
+	}
+}
+
+// Prune deletes all the trie nodes which are not reachable from the given state
+// roots, returning the number of deleted nodes. The retained states must be
+// complete, the pruning is aborted without deleting anything otherwise.
+func (p *Pruner) Prune(roots ...common.Hash) (int, error) {
+	if len(roots) == 0 {
+		return 0, errors.New("no state root to retain")
+	}
+	triedb := NewTrieDB(p.db)
+	for _, root := range roots {
+		if err := p.mark(triedb, root); err != nil {
+			return 0, err
+		}
+	}
+	return p.sweep()
+}
+
+// mark adds all the nodes of the given state, including the storage tries
+// referenced by the accounts, into the bloom filter.
+func (p *Pruner) mark(triedb *TrieDB, root common.Hash) error {
+	if root == emptyRoot || root == (common.Hash{}) {
+		return nil
+	}
+	accTrie, err := New(StateTrieID(root), triedb)
+	if err != nil {
+		return err
+	}
+	it := accTrie.NodeIterator(nil)
+	for it.Next(true) {
+		if hash := it.Hash(); hash != (common.Hash{}) {
+			p.bloom.add(hash[:])
+		}
+		if !it.Leaf() {
+			continue
+		}
+		var account types.StateAccount
+		if err := rlp.DecodeBytes(it.LeafBlob(), &account); err != nil || account.Root == emptyRoot || account.Root == (common.Hash{}) {
+			continue
+		}
+		owner := common.BytesToHash(it.LeafKey())
+		stTrie, err := New(StorageTrieID(root, owner, account.Root), triedb)
+		if err != nil {
+			return err
+		}
+		sit := stTrie.NodeIterator(nil)
+		for sit.Next(true) {
+			if hash := sit.Hash(); hash != (common.Hash{}) {
+				p.bloom.add(hash[:])
+			}
+		}
+		if err := sit.Error(); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// sweep deletes all the hash-keyed trie nodes not marked in the bloom filter.
+// Only the entries whose key is the hash of the value are considered as
+// trie nodes, the other database content is left untouched.
+func (p *Pruner) sweep() (int, error) {
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+
+	var (
+		deleted int
+		batch   = p.db.NewBatch()
+		it      = p.db.NewIterator(nil, nil)
+	)
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+		if len(key) != common.HashLength || p.bloom.contain(key) {
+			continue
+		}
+		if !bytes.Equal(h.hashData(it.Value()), key) {
+			continue
+		}
+		if err := batch.Delete(key); err != nil {
+			return deleted, err
+		}
+		deleted++
+		if batch.ValueSize() >= accdb.IdealBatchSize {
+			if err := batch.Submit(); err != nil {
+				return deleted, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return deleted, err
+	}
+	return deleted, batch.Submit()
+}
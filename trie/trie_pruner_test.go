@@ -0,0 +1,102 @@
+package trie
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/jaiminpan/mt-trie/accdb/memorydb"
+	"github.com/jaiminpan/mt-trie/common"
+	"github.com/jaiminpan/mt-trie/rlp"
+	"github.com/jaiminpan/mt-trie/types"
+)
+
+// checkState ensures all the nodes of the given state, including the storage
+// tries, are resolvable from the database.
+func checkState(db *TrieDB, root common.Hash) error {
+	trie, err := New(StateTrieID(root), db)
+	if err != nil {
+		return err
+	}
+	var roots []*ID
+	it := NewIterator(trie.NodeIterator(nil))
+	for it.Next() {
+		var account types.StateAccount
+		if err := rlp.DecodeBytes(it.Value, &account); err == nil && account.Root != emptyRoot {
+			roots = append(roots, StorageTrieID(root, common.BytesToHash(it.Key), account.Root))
+		}
+	}
+	if it.Err != nil {
+		return it.Err
+	}
+	for _, id := range roots {
+		trie, err := New(id, db)
+		if err != nil {
+			return err
+		}
+		nit := trie.NodeIterator(nil)
+		for nit.Next(true) {
+		}
+		if nit.Error() != nil {
+			return nit.Error()
+		}
+	}
+	return nil
+}
+
+func TestPruner(t *testing.T) {
+	diskdb := NewMemoryDatabase()
+	db := NewTrieDB(diskdb)
+
+	// Create a few versions of a state, every version changes the storage
+	// of all the accounts.
+	var (
+		roots  []common.Hash
+		parent = emptyRoot
+		hashes []common.Hash
+	)
+	for i := 0; i < 16; i++ {
+		hashes = append(hashes, common.BytesToHash(randBytes(32)))
+	}
+	for i := 0; i < 4; i++ {
+		accounts := make(map[common.Hash]*types.StateAccount)
+		storage := make(map[common.Hash]map[common.Hash][]byte)
+		for j, hash := range hashes {
+			accounts[hash] = &types.StateAccount{Balance: big.NewInt(int64(i*100 + j + 1))}
+			storage[hash] = map[common.Hash][]byte{
+				common.BytesToHash(randBytes(32)): randBytes(20),
+			}
+		}
+		root, _ := updateState(t, db, parent, accounts, storage)
+		roots, parent = append(roots, root), root
+	}
+	// Preimages are not trie nodes, they must survive the pruning
+	db.preimages.insertPreimage(map[common.Hash][]byte{{0x1}: []byte("preimage")})
+	db.Commit(roots[3])
+
+	size := diskdb.(*memorydb.MemDB).Len()
+	deleted, err := NewPruner(diskdb, 1).Prune(roots[1], roots[3])
+	if err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+	if deleted == 0 || diskdb.(*memorydb.MemDB).Len() != size-deleted {
+		t.Fatalf("Unexpected pruning result: %d of %d entries deleted", deleted, size)
+	}
+	db = NewTrieDB(diskdb)
+	for _, i := range []int{1, 3} {
+		if err := checkState(db, roots[i]); err != nil {
+			t.Fatalf("Retained state %d is incomplete: %v", i, err)
+		}
+	}
+	for _, i := range []int{0, 2} {
+		if err := checkState(db, roots[i]); err == nil {
+			t.Fatalf("Expected pruned state %d to be incomplete", i)
+		}
+	}
+	if blob := db.Preimage(common.Hash{0x1}); string(blob) != "preimage" {
+		t.Fatalf("Unexpected preimage: %q", blob)
+	}
+	// Pruning an incomplete state is rejected
+	if _, err := NewPruner(diskdb, 1).Prune(roots[0]); err == nil {
+		t.Fatal("Expected error pruning with an incomplete state")
+	}
+}
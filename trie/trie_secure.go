@@ -0,0 +1,294 @@
+package trie
+
+import (
+	"fmt"
+
+	"github.com/jaiminpan/mt-trie/accdb"
+	"github.com/jaiminpan/mt-trie/common"
+	"github.com/jaiminpan/mt-trie/crypto"
+	"github.com/jaiminpan/mt-trie/rlp"
+	"github.com/jaiminpan/mt-trie/types"
+)
+
+// SecureTrie is the old name of StateTrie.
+// Deprecated: use StateTrie.
+type SecureTrie = StateTrie
+
+// NewSecure creates a new StateTrie.
+// Deprecated: use NewStateTrie.
+func NewSecure(id *ID, db *TrieDB) (*SecureTrie, error) {
+	return NewStateTrie(id, db)
+}
+
+// StateTrie wraps a trie with key hashing. In a stateTrie trie, all
+// access operations hash the key using keccak256. This prevents
+// calling code from creating long chains of nodes that
+// increase the access time.
+//
+// Contrary to a regular trie, a StateTrie can only be created with
+// NewStateTrie and must have an attached database. The database also
+// stores the preimage of each key, which can be recovered with GetKey.
+//
+// StateTrie is not safe for concurrent use.
+type StateTrie struct {
+	trie             Trie
+	preimages        *preimageStore
+	sha              crypto.KeccakState
+	hashKeyBuf       [common.HashLength]byte
+	secKeyCache      map[string][]byte
+	secKeyCacheOwner *StateTrie // Pointer to self, replace the key cache on mismatch
+	snap             *Snapshot  // Snapshot serving the reads, nil once the trie is modified
+}
+
+// NewStateTrie creates a trie with an existing root node from a backing database.
+//
+// If root is the zero hash or the sha3 hash of an empty string, the
+// trie is initially empty. Otherwise, New will panic if db is nil
+// and returns MissingNodeError if the root node cannot be found.
+func NewStateTrie(id *ID, db *TrieDB) (*StateTrie, error) {
+	if db == nil {
+		panic("trie.NewStateTrie called without a database")
+	}
+	trie, err := New(id, db)
+	if err != nil {
+		return nil, err
+	}
+	return &StateTrie{
+		trie:      *trie,
+		preimages: db.preimages,
+		sha:       crypto.NewKeccakState(),
+	}, nil
+}
+
+// Get returns the value for key stored in the trie.
+// The value bytes must not be modified by the caller.
+func (t *StateTrie) Get(key []byte) []byte {
+	res, err := t.TryGet(key)
+	if err != nil {
+		panic(fmt.Sprintf("unhandled trie error in StateTrie.Get: %v", err))
+	}
+	return res
+}
+
+// TryGet returns the value for key stored in the trie.
+// The value bytes must not be modified by the caller.
+// If the specified node is not in the trie, nil will be returned.
+// If a trie node is not found in the database, a MissingNodeError is returned.
+func (t *StateTrie) TryGet(key []byte) ([]byte, error) {
+	return t.get(t.hashKey(key))
+}
+
+// UseSnapshot makes the trie serve its reads from the given snapshot as long
+// as the snapshot belongs to the state the trie was opened in and the trie is
+// not modified. The entries the snapshot doesn't cover yet are read from the
+// trie. The first modification of the trie detaches the snapshot. The snapshot
+// is bypassed while the witness collection is enabled, the witness has to
+// cover the trie nodes of every read.
+func (t *StateTrie) UseSnapshot(snap *Snapshot) {
+	t.snap = snap
+}
+
+// get retrieves the value stored under the given hashed key from the snapshot
+// if possible, falling back to the trie otherwise. The trie is always used if
+// the witness collection is enabled.
+func (t *StateTrie) get(hk []byte) ([]byte, error) {
+	if t.snap != nil && t.trie.witness == nil {
+		blob, err := t.snap.get(t.trie.state, t.trie.owner, common.BytesToHash(hk))
+		if err == nil {
+			return blob, nil
+		}
+	}
+	return t.trie.TryGet(hk)
+}
+
+// GetAccount attempts to retrieve an account with provided account address.
+// If the specified account is not in the trie, nil will be returned.
+// If a trie node is not found in the database, a MissingNodeError is returned.
+func (t *StateTrie) GetAccount(address common.Address) (*types.StateAccount, error) {
+	res, err := t.get(t.hashKey(address[:]))
+	if res == nil || err != nil {
+		return nil, err
+	}
+	ret := new(types.StateAccount)
+	err = rlp.DecodeBytes(res, ret)
+	return ret, err
+}
+
+// UpdateAccount will abstract the write of an account to the secure trie.
+// The account is RLP-encoded and stored under the hash of its address.
+// If a node is not found in the database, a MissingNodeError is returned.
+func (t *StateTrie) UpdateAccount(address common.Address, acc *types.StateAccount) error {
+	t.snap = nil
+	hk := t.hashKey(address[:])
+	data, err := rlp.EncodeToBytes(acc)
+	if err != nil {
+		return err
+	}
+	if err := t.trie.TryUpdate(hk, data); err != nil {
+		return err
+	}
+	t.getSecKeyCache()[string(hk)] = common.CopyBytes(address[:])
+	return nil
+}
+
+// DeleteAccount abstracts an account deletion from the trie.
+// If the specified account is not in the trie, nothing will be changed.
+// If a node is not found in the database, a MissingNodeError is returned.
+func (t *StateTrie) DeleteAccount(address common.Address) error {
+	t.snap = nil
+	hk := t.hashKey(address[:])
+	delete(t.getSecKeyCache(), string(hk))
+	return t.trie.TryDelete(hk)
+}
+
+// Update associates key with value in the trie. Subsequent calls to
+// Get will return value. If value has length zero, any existing value
+// is deleted from the trie and calls to Get will return nil.
+//
+// The value bytes must not be modified by the caller while they are
+// stored in the trie.
+func (t *StateTrie) Update(key, value []byte) {
+	if err := t.TryUpdate(key, value); err != nil {
+		panic(fmt.Sprintf("unhandled trie error in StateTrie.Update: %v", err))
+	}
+}
+
+// TryUpdate associates key with value in the trie. Subsequent calls to
+// Get will return value. If value has length zero, any existing value
+// is deleted from the trie and calls to Get will return nil.
+//
+// The value bytes must not be modified by the caller while they are
+// stored in the trie.
+//
+// If a node is not found in the database, a MissingNodeError is returned.
+func (t *StateTrie) TryUpdate(key, value []byte) error {
+	t.snap = nil
+	hk := t.hashKey(key)
+	err := t.trie.TryUpdate(hk, value)
+	if err != nil {
+		return err
+	}
+	t.getSecKeyCache()[string(hk)] = common.CopyBytes(key)
+	return nil
+}
+
+// Delete removes any existing value for key from the trie.
+func (t *StateTrie) Delete(key []byte) {
+	if err := t.TryDelete(key); err != nil {
+		panic(fmt.Sprintf("unhandled trie error in StateTrie.Delete: %v", err))
+	}
+}
+
+// TryDelete removes any existing value for key from the trie.
+// If the specified trie node is not in the trie, nothing will be changed.
+// If a node is not found in the database, a MissingNodeError is returned.
+func (t *StateTrie) TryDelete(key []byte) error {
+	t.snap = nil
+	hk := t.hashKey(key)
+	delete(t.getSecKeyCache(), string(hk))
+	return t.trie.TryDelete(hk)
+}
+
+// GetKey returns the sha3 preimage of a hashed key that was
+// previously used to store a value.
+func (t *StateTrie) GetKey(shaKey []byte) []byte {
+	if key, ok := t.getSecKeyCache()[string(shaKey)]; ok {
+		return key
+	}
+	if t.preimages == nil {
+		return nil
+	}
+	return t.preimages.preimage(common.BytesToHash(shaKey))
+}
+
+// Commit collects all dirty nodes in the trie and replaces them with the
+// corresponding node hash. All collected nodes (including dirty leaves if
+// collectLeaf is true) will be encapsulated into a nodeset for return.
+// The returned nodeset can be nil if the trie is clean (nothing to commit).
+// All cached preimages are also handed over to the preimage store of the database.
+// Once the trie is committed, it's not usable anymore. A new trie must
+// be created with new root and updated trie database for following usage
+func (t *StateTrie) Commit(collectLeaf bool) (common.Hash, *NodeSet, error) {
+	t.commitPreimages()
+
+	// Commit the trie and return its modified nodeset.
+	return t.trie.Commit(collectLeaf)
+}
+
+// CommitParallel is the concurrent version of Commit, see Trie.CommitParallel.
+func (t *StateTrie) CommitParallel(collectLeaf bool) (common.Hash, *NodeSet, error) {
+	t.commitPreimages()
+	return t.trie.CommitParallel(collectLeaf)
+}
+
+// commitPreimages hands over the cached preimages to the preimage store.
+func (t *StateTrie) commitPreimages() {
+	// Write all the pre-images to the actual disk database
+	if len(t.getSecKeyCache()) > 0 {
+		if t.preimages != nil {
+			preimages := make(map[common.Hash][]byte)
+			for hk, key := range t.secKeyCache {
+				preimages[common.BytesToHash([]byte(hk))] = key
+			}
+			t.preimages.insertPreimage(preimages)
+		}
+		t.secKeyCache = make(map[string][]byte)
+	}
+}
+
+// Hash returns the root hash of StateTrie. It does not write to the
+// database and can be used even if the trie doesn't have one.
+func (t *StateTrie) Hash() common.Hash {
+	return t.trie.Hash()
+}
+
+// EnableWitness turns on the witness collection, see Trie.EnableWitness.
+func (t *StateTrie) EnableWitness() {
+	t.trie.EnableWitness()
+}
+
+// Witness returns the recorded trie nodes, see Trie.Witness.
+func (t *StateTrie) Witness() [][]byte {
+	return t.trie.Witness()
+}
+
+// Copy returns a copy of StateTrie. The key preimages which are not committed
+// yet stay with the original trie.
+func (t *StateTrie) Copy() *StateTrie {
+	return &StateTrie{
+		trie:      *t.trie.Copy(),
+		preimages: t.preimages,
+		sha:       crypto.NewKeccakState(),
+		snap:      t.snap,
+	}
+}
+
+// NodeIterator returns an iterator that returns nodes of the underlying trie. Iteration
+// starts at the key after the given start key.
+func (t *StateTrie) NodeIterator(start []byte) NodeIterator {
+	return t.trie.NodeIterator(start)
+}
+
+// Prove constructs a merkle proof for key. The key is hashed first, the
+// result contains all encoded nodes on the path to the value at key.
+func (t *StateTrie) Prove(key []byte, proofDb accdb.KeyValueWriter) error {
+	return t.trie.Prove(t.hashKey(key), proofDb)
+}
+
+// hashKey returns the hash of key as an ephemeral buffer.
+// The caller must not hold onto the return value because it will become
+// invalid on the next call to hashKey.
+func (t *StateTrie) hashKey(key []byte) []byte {
+	return crypto.HashData(t.sha, key, t.hashKeyBuf[:])
+}
+
+// getSecKeyCache returns the current secure key cache, creating a new one if
+// ownership changed (i.e. the current secure trie is a copy of another owning
+// the actual cache).
+func (t *StateTrie) getSecKeyCache() map[string][]byte {
+	if t != t.secKeyCacheOwner {
+		t.secKeyCacheOwner = t
+		t.secKeyCache = make(map[string][]byte)
+	}
+	return t.secKeyCache
+}
@@ -0,0 +1,266 @@
+package trie
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/jaiminpan/mt-trie/accdb/memorydb"
+	"github.com/jaiminpan/mt-trie/common"
+	"github.com/jaiminpan/mt-trie/crypto"
+	"github.com/jaiminpan/mt-trie/types"
+)
+
+func newEmptySecure() *StateTrie {
+	trie, _ := NewStateTrie(TrieID(common.Hash{}), NewTrieDB(NewMemoryDatabase()))
+	return trie
+}
+
+// makeTestStateTrie creates a large enough secure trie for testing.
+func makeTestStateTrie() (*TrieDB, *StateTrie, map[string][]byte) {
+	triedb := NewTrieDB(NewMemoryDatabase())
+	trie, _ := NewStateTrie(TrieID(common.Hash{}), triedb)
+
+	// Fill it with some arbitrary data
+	content := make(map[string][]byte)
+	for i := byte(0); i < 255; i++ {
+		// Map the same data under multiple keys
+		for _, prefix := range []byte{1, 2} {
+			key, val := make([]byte, 32), []byte{i}
+			key[30], key[31] = prefix, i
+			content[string(key)] = val
+			trie.Update(key, val)
+		}
+	}
+	root, nodes, err := trie.Commit(false)
+	if err != nil {
+		panic(err)
+	}
+	merged := NewMergedNodeSet()
+	merged.Merge(nodes)
+	if err := triedb.Update(root, emptyRoot, merged); err != nil {
+		panic(err)
+	}
+	// Re-create the trie based on the new state
+	trie, _ = NewStateTrie(TrieID(root), triedb)
+	return triedb, trie, content
+}
+
+func TestSecureDelete(t *testing.T) {
+	trie := newEmptySecure()
+	vals := []struct{ k, v string }{
+		{"do", "verb"},
+		{"ether", "wookiedoo"},
+		{"horse", "stallion"},
+		{"shaman", "horse"},
+		{"doge", "coin"},
+		{"ether", ""},
+		{"dog", "puppy"},
+		{"shaman", ""},
+	}
+	for _, val := range vals {
+		if val.v != "" {
+			trie.Update([]byte(val.k), []byte(val.v))
+		} else {
+			trie.Delete([]byte(val.k))
+		}
+	}
+	hash := trie.Hash()
+	exp := common.HexToHash("29b235a58c3c25ab83010c327d5932bcf05324b7d6b1185e650798034783ca9d")
+	if hash != exp {
+		t.Errorf("expected %x got %x", exp, hash)
+	}
+}
+
+func TestSecureGetKey(t *testing.T) {
+	trie := newEmptySecure()
+	trie.Update([]byte("foo"), []byte("bar"))
+
+	key := []byte("foo")
+	value := []byte("bar")
+	seckey := crypto.HashData(crypto.NewKeccakState(), key, make([]byte, common.HashLength))
+
+	if !bytes.Equal(trie.Get(key), value) {
+		t.Errorf("Get did not return bar")
+	}
+	if k := trie.GetKey(seckey); !bytes.Equal(k, key) {
+		t.Errorf("GetKey returned %q, want %q", k, key)
+	}
+}
+
+func TestSecurePreimages(t *testing.T) {
+	triedb, trie, content := makeTestStateTrie()
+
+	// The preimages are moved into the database by the commit, so a fresh
+	// trie instance is able to recover the original keys while iterating.
+	it := NewIterator(trie.NodeIterator(nil))
+	count := 0
+	for it.Next() {
+		key := trie.GetKey(it.Key)
+		if key == nil {
+			t.Fatalf("Missing preimage for %x", it.Key)
+		}
+		if want, ok := content[string(key)]; !ok || !bytes.Equal(it.Value, want) {
+			t.Fatalf("Value mismatch for %x: have %x, want %x", key, it.Value, want)
+		}
+		count++
+	}
+	if count != len(content) {
+		t.Fatalf("Iterated %d entries, want %d", count, len(content))
+	}
+	// Committing the database flushes the preimages to disk.
+	if err := triedb.Commit(trie.Hash()); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if size := triedb.preimages.size(); size != 0 {
+		t.Fatalf("Preimage cache not flushed: %v", size)
+	}
+	fresh := NewTrieDB(triedb.diskdb)
+	for key := range content {
+		hash := common.BytesToHash(crypto.HashData(crypto.NewKeccakState(), []byte(key), make([]byte, common.HashLength)))
+		if preimage := fresh.Preimage(hash); !bytes.Equal(preimage, []byte(key)) {
+			t.Fatalf("Preimage mismatch: have %x, want %x", preimage, key)
+		}
+	}
+}
+
+func TestSecureAccounts(t *testing.T) {
+	triedb := NewTrieDB(NewMemoryDatabase())
+	trie, _ := NewStateTrie(TrieID(common.Hash{}), triedb)
+
+	addr := common.HexToAddress("0x0102030405060708090a0b0c0d0e0f1011121314")
+	acc := &types.StateAccount{
+		Nonce:    1,
+		Balance:  big.NewInt(100),
+		Root:     emptyRoot,
+		CodeHash: crypto.HashData(crypto.NewKeccakState(), nil, make([]byte, common.HashLength)),
+	}
+	if have, err := trie.GetAccount(addr); err != nil || have != nil {
+		t.Fatalf("Unexpected account before insertion: %v, %v", have, err)
+	}
+	if err := trie.UpdateAccount(addr, acc); err != nil {
+		t.Fatalf("Failed to update account: %v", err)
+	}
+	// The account is stored RLP-encoded under the hashed address.
+	if key := trie.GetKey(trie.hashKey(addr[:])); !bytes.Equal(key, addr[:]) {
+		t.Fatalf("Preimage mismatch: have %x, want %x", key, addr)
+	}
+	root, nodes, err := trie.Commit(true)
+	if err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	merged := NewMergedNodeSet()
+	merged.Merge(nodes)
+	if err := triedb.Update(root, emptyRoot, merged); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	trie, _ = NewStateTrie(TrieID(root), triedb)
+	have, err := trie.GetAccount(addr)
+	if err != nil {
+		t.Fatalf("Failed to retrieve account: %v", err)
+	}
+	if have.Nonce != acc.Nonce || have.Balance.Cmp(acc.Balance) != 0 || have.Root != acc.Root || !bytes.Equal(have.CodeHash, acc.CodeHash) {
+		t.Fatalf("Account mismatch: have %+v, want %+v", have, acc)
+	}
+	if err := trie.DeleteAccount(addr); err != nil {
+		t.Fatalf("Failed to delete account: %v", err)
+	}
+	if have, _ := trie.GetAccount(addr); have != nil {
+		t.Fatalf("Account not deleted: %+v", have)
+	}
+	if trie.Hash() != emptyRoot {
+		t.Fatalf("Trie not empty after deletion: %x", trie.Hash())
+	}
+}
+
+func TestStorageTries(t *testing.T) {
+	diskdb := NewMemoryDatabase()
+	triedb := NewTrieDB(diskdb)
+	accTrie, _ := NewStateTrie(StateTrieID(emptyRoot), triedb)
+
+	// Create the storage tries of a few accounts and merge all the produced
+	// node sets together with the account trie changes.
+	var (
+		merged   = NewMergedNodeSet()
+		addrs    []common.Address
+		storages = make(map[common.Address]map[string]string)
+		roots    = make(map[common.Address]common.Hash)
+	)
+	for i := byte(1); i <= 3; i++ {
+		addr := common.BytesToAddress([]byte{i})
+		owner := common.BytesToHash(accTrie.hashKey(addr[:]))
+
+		stTrie, err := NewStateTrie(StorageTrieID(emptyRoot, owner, emptyRoot), triedb)
+		if err != nil {
+			t.Fatalf("Failed to open storage trie: %v", err)
+		}
+		slots := make(map[string]string)
+		for j := 0; j < 32; j++ {
+			k, v := string(randBytes(32)), string(randBytes(16))
+			slots[k] = v
+			stTrie.Update([]byte(k), []byte(v))
+		}
+		root, nodes, err := stTrie.Commit(false)
+		if err != nil {
+			t.Fatalf("Failed to commit storage trie: %v", err)
+		}
+		if nodes.Owner() != owner {
+			t.Fatalf("Node set owner mismatch: have %x, want %x", nodes.Owner(), owner)
+		}
+		if err := merged.Merge(nodes); err != nil {
+			t.Fatalf("Failed to merge storage nodes: %v", err)
+		}
+		if err := accTrie.UpdateAccount(addr, &types.StateAccount{Balance: big.NewInt(int64(i)), Root: root}); err != nil {
+			t.Fatalf("Failed to update account: %v", err)
+		}
+		addrs, storages[addr], roots[addr] = append(addrs, addr), slots, root
+	}
+	stateRoot, nodes, err := accTrie.Commit(true)
+	if err != nil {
+		t.Fatalf("Failed to commit account trie: %v", err)
+	}
+	if nodes.Owner() != (common.Hash{}) {
+		t.Fatalf("Account node set has owner %x", nodes.Owner())
+	}
+	merged.Merge(nodes)
+	if err := triedb.Update(stateRoot, emptyRoot, merged); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	// The storage tries are linked to the account trie, committing the state
+	// root flushes them as well.
+	if err := triedb.Commit(stateRoot); err != nil {
+		t.Fatalf("Failed to commit database: %v", err)
+	}
+	if n := len(triedb.Nodes()); n != 0 {
+		t.Fatalf("Dirty cache not empty after commit: %d nodes", n)
+	}
+	triedb = NewTrieDB(diskdb)
+	accTrie, _ = NewStateTrie(StateTrieID(stateRoot), triedb)
+	for _, addr := range addrs {
+		acc, err := accTrie.GetAccount(addr)
+		if err != nil || acc == nil {
+			t.Fatalf("Failed to retrieve account %x: %v", addr, err)
+		}
+		if acc.Root != roots[addr] {
+			t.Fatalf("Storage root mismatch: have %x, want %x", acc.Root, roots[addr])
+		}
+		owner := common.BytesToHash(accTrie.hashKey(addr[:]))
+		stTrie, err := NewStateTrie(StorageTrieID(stateRoot, owner, acc.Root), triedb)
+		if err != nil {
+			t.Fatalf("Failed to open storage trie: %v", err)
+		}
+		for k, v := range storages[addr] {
+			if have := stTrie.Get([]byte(k)); !bytes.Equal(have, []byte(v)) {
+				t.Fatalf("Slot mismatch: have %x, want %x", have, v)
+			}
+		}
+	}
+	// Missing storage nodes are reported with the owner of the trie.
+	owner := common.BytesToHash(accTrie.hashKey(addrs[0][:]))
+	root := roots[addrs[0]]
+	diskdb.(*memorydb.MemDB).Delete(root[:])
+	_, err = NewStateTrie(StorageTrieID(stateRoot, owner, root), triedb)
+	if mErr, ok := err.(*MissingNodeError); !ok || mErr.Owner != owner {
+		t.Fatalf("Expected missing node error with owner %x, got %v", owner, err)
+	}
+}
@@ -0,0 +1,511 @@
+package trie
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jaiminpan/mt-trie/accdb"
+	"github.com/jaiminpan/mt-trie/common"
+	"github.com/jaiminpan/mt-trie/rlp"
+	"github.com/jaiminpan/mt-trie/types"
+)
+
+var (
+	// ErrNotCoveredYet is returned from the snapshot if the requested entry is
+	// not generated yet.
+	ErrNotCoveredYet = errors.New("not covered yet")
+
+	// ErrNotConstructed is returned if the snapshot is still being generated.
+	ErrNotConstructed = errors.New("snapshot is not constructed")
+
+	// errSnapshotStale is returned if the snapshot belongs to another state root
+	// than the requested one.
+	errSnapshotStale = errors.New("snapshot is stale")
+)
+
+var (
+	// snapshotAccountPrefix + account hash -> account trie value
+	snapshotAccountPrefix = []byte("a")
+
+	// snapshotStoragePrefix + account hash + storage hash -> storage trie value
+	snapshotStoragePrefix = []byte("o")
+
+	// snapshotRootKey tracks the state root the snapshot belongs to.
+	snapshotRootKey = []byte("SnapshotRoot")
+
+	// snapshotGeneratorKey tracks the progress of the snapshot generation,
+	// it's absent once the snapshot is complete.
+	snapshotGeneratorKey = []byte("SnapshotGenerator")
+)
+
+// accountSnapshotKey = snapshotAccountPrefix + hash
+func accountSnapshotKey(hash common.Hash) []byte {
+	return append(append([]byte{}, snapshotAccountPrefix...), hash[:]...)
+}
+
+// storageSnapshotKey = snapshotStoragePrefix + account hash + storage hash
+func storageSnapshotKey(account common.Hash, hash common.Hash) []byte {
+	key := make([]byte, 0, len(snapshotStoragePrefix)+2*common.HashLength)
+	key = append(key, snapshotStoragePrefix...)
+	key = append(key, account[:]...)
+	return append(key, hash[:]...)
+}
+
+// storageSnapshotPrefix = snapshotStoragePrefix + account hash
+func storageSnapshotPrefix(account common.Hash) []byte {
+	return append(append([]byte{}, snapshotStoragePrefix...), account[:]...)
+}
+
+// Snapshot is a flat representation of a state, the account trie values are
+// stored under the hashed account keys and the storage trie values under the
+// hashed account and storage keys. It allows retrieving the state entries
+// with a single disk read instead of walking the trie nodes.
+//
+// The snapshot belongs to a single state root and has to be moved forward by
+// Update along with the committed tries. If the persisted snapshot doesn't
+// match the requested root, it's regenerated in the background from the trie
+// data. The entries not generated yet are reported by ErrNotCoveredYet.
+// State tries can serve their reads from the snapshot, see StateTrie.UseSnapshot.
+type Snapshot struct {
+	diskdb accdb.KeyValueStore // Persistent storage of the flat entries
+	triedb *TrieDB             // Trie database to generate the snapshot from
+
+	root      common.Hash        // State root the snapshot belongs to
+	genMarker []byte             // Last generated account hash, nil if the generation is done
+	genAbort  chan chan struct{} // Notification channel to abort the running generator
+	genDone   chan struct{}      // Channel closed once the generation is done or failed
+	genErr    error              // Error the generation failed with, if any
+
+	lock sync.RWMutex
+}
+
+// NewSnapshot opens the snapshot of the given state root. The persisted
+// snapshot is used if it belongs to the root, an interrupted generation is
+// resumed. Otherwise the persisted entries are wiped and the snapshot is
+// regenerated from the tries in the background.
+func NewSnapshot(diskdb accdb.KeyValueStore, triedb *TrieDB, root common.Hash) (*Snapshot, error) {
+	snap := &Snapshot{
+		diskdb:  diskdb,
+		triedb:  triedb,
+		root:    root,
+		genDone: make(chan struct{}),
+	}
+	blob, _ := diskdb.Get(snapshotRootKey)
+	if bytes.Equal(blob, root[:]) {
+		marker, _ := diskdb.Get(snapshotGeneratorKey)
+		if marker == nil {
+			close(snap.genDone)
+			return snap, nil
+		}
+		// The generator key holds the marker behind a version byte, so
+		// that a not yet started generation is distinguishable.
+		snap.genMarker = marker[1:]
+	} else {
+		if err := wipeSnapshot(diskdb, root); err != nil {
+			return nil, err
+		}
+		snap.genMarker = []byte{}
+	}
+	snap.genAbort = make(chan chan struct{})
+	go snap.generate(root, snap.genMarker, snap.genAbort)
+	return snap, nil
+}
+
+// wipeSnapshot deletes all the persisted snapshot entries and marks the
+// snapshot of the given root as not generated yet.
+func wipeSnapshot(diskdb accdb.KeyValueStore, root common.Hash) error {
+	batch := diskdb.NewBatch()
+	for prefix, keylen := range map[string]int{
+		string(snapshotAccountPrefix): len(snapshotAccountPrefix) + common.HashLength,
+		string(snapshotStoragePrefix): len(snapshotStoragePrefix) + 2*common.HashLength,
+	} {
+		it := diskdb.NewIterator([]byte(prefix), nil)
+		for it.Next() {
+			key := it.Key()
+			if len(key) != keylen {
+				continue
+			}
+			if err := batch.Delete(key); err != nil {
+				it.Release()
+				return err
+			}
+			if batch.ValueSize() >= accdb.IdealBatchSize {
+				if err := batch.Submit(); err != nil {
+					it.Release()
+					return err
+				}
+				batch.Reset()
+			}
+		}
+		it.Release()
+	}
+	if err := batch.Put(snapshotRootKey, root[:]); err != nil {
+		return err
+	}
+	if err := batch.Put(snapshotGeneratorKey, []byte{0}); err != nil {
+		return err
+	}
+	return batch.Submit()
+}
+
+// Root returns the state root the snapshot belongs to.
+func (s *Snapshot) Root() common.Hash {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.root
+}
+
+// Generated reports whether the snapshot is completely generated.
+func (s *Snapshot) Generated() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.genMarker == nil
+}
+
+// Wait blocks until the snapshot generation is done and returns the error the
+// generation failed with, if any. A failed generation is resumed only once the
+// snapshot is opened again, the entries not generated until the failure keep
+// being reported by ErrNotCoveredYet.
+func (s *Snapshot) Wait() error {
+	<-s.genDone
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.genErr
+}
+
+// covered reports whether the entries of the given account are generated.
+//
+// Note, this method assumes the snapshot lock is held by the caller.
+func (s *Snapshot) covered(account common.Hash) bool {
+	return s.genMarker == nil || (len(s.genMarker) > 0 && bytes.Compare(account[:], s.genMarker) <= 0)
+}
+
+// Account retrieves the account trie value stored under the given account hash,
+// nil is returned if the account doesn't exist.
+func (s *Snapshot) Account(hash common.Hash) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.covered(hash) {
+		return nil, ErrNotCoveredYet
+	}
+	blob, _ := s.diskdb.Get(accountSnapshotKey(hash))
+	return blob, nil
+}
+
+// Storage retrieves the storage trie value stored under the given account and
+// storage hash, nil is returned if the slot doesn't exist.
+func (s *Snapshot) Storage(account common.Hash, hash common.Hash) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.covered(account) {
+		return nil, ErrNotCoveredYet
+	}
+	blob, _ := s.diskdb.Get(storageSnapshotKey(account, hash))
+	return blob, nil
+}
+
+// get retrieves the value stored under the given hashed key in the trie of the
+// given owner, the account trie has no owner. Unlike Account and Storage, the
+// snapshot has to belong to the given state root, errSnapshotStale is returned
+// otherwise.
+func (s *Snapshot) get(root common.Hash, owner common.Hash, hash common.Hash) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.root != root {
+		return nil, errSnapshotStale
+	}
+	account, key := owner, accountSnapshotKey(hash)
+	if owner == (common.Hash{}) {
+		account = hash
+	} else {
+		key = storageSnapshotKey(owner, hash)
+	}
+	if !s.covered(account) {
+		return nil, ErrNotCoveredYet
+	}
+	blob, _ := s.diskdb.Get(key)
+	return blob, nil
+}
+
+// Update moves the snapshot from the parent state to the given root by applying
+// the changed entries of the tries committed in between. The entries must be
+// exactly the ones written into the state tries:
+//
+//   - accounts maps the hashed address of every account changed in the account
+//     trie, including the accounts whose storage root changed, to the new
+//     value stored in the account trie, i.e. the RLP-encoded StateAccount
+//   - storage maps the hashed address of every account with changed storage to
+//     the hashed slot keys and the new values stored in the storage trie
+//
+// Nil values mark deleted entries, the storage of a deleted account is wiped
+// as well. Any entry left out makes the snapshot diverge from the tries, which
+// is only detected by Verify.
+//
+// The running generator is suspended during the update and continues from the
+// new root afterwards, so the entries not generated yet are taken from the
+// trie of the new state.
+func (s *Snapshot) Update(root common.Hash, parent common.Hash, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) error {
+	s.lock.RLock()
+	current, abort := s.root, s.genAbort
+	s.lock.RUnlock()
+
+	if current != parent {
+		return fmt.Errorf("snapshot root mismatch: have %x, want %x", current, parent)
+	}
+	// Suspend the generator, it has to continue from the new root
+	if abort != nil {
+		stop := make(chan struct{})
+		abort <- stop
+		<-stop
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Resume the generator on top of the new root, even if the update fails
+	defer func() {
+		s.genAbort = nil
+		if s.genMarker != nil && s.genErr == nil {
+			s.genAbort = make(chan chan struct{})
+			go s.generate(s.root, s.genMarker, s.genAbort)
+		}
+	}()
+	batch := s.diskdb.NewBatch()
+	for hash, blob := range accounts {
+		if !s.covered(hash) {
+			continue
+		}
+		if len(blob) != 0 {
+			if err := batch.Put(accountSnapshotKey(hash), blob); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := batch.Delete(accountSnapshotKey(hash)); err != nil {
+			return err
+		}
+		it := s.diskdb.NewIterator(storageSnapshotPrefix(hash), nil)
+		for it.Next() {
+			if err := batch.Delete(it.Key()); err != nil {
+				it.Release()
+				return err
+			}
+		}
+		it.Release()
+	}
+	for account, slots := range storage {
+		if !s.covered(account) {
+			continue
+		}
+		for hash, blob := range slots {
+			var err error
+			if len(blob) != 0 {
+				err = batch.Put(storageSnapshotKey(account, hash), blob)
+			} else {
+				err = batch.Delete(storageSnapshotKey(account, hash))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := batch.Put(snapshotRootKey, root[:]); err != nil {
+		return err
+	}
+	if err := batch.Submit(); err != nil {
+		return err
+	}
+	s.root = root
+	return nil
+}
+
+// Close terminates the running generator, the generation is resumed from the
+// persisted progress when the snapshot is opened again.
+func (s *Snapshot) Close() {
+	s.lock.Lock()
+	abort := s.genAbort
+	s.genAbort = nil
+	s.lock.Unlock()
+
+	if abort != nil {
+		stop := make(chan struct{})
+		abort <- stop
+		<-stop
+	}
+}
+
+// generate iterates the account trie of the given root starting after the
+// marker and writes the accounts along with their storage into the snapshot.
+// The progress is persisted along with every flushed batch, so an interrupted
+// generation can be continued later. It runs until the snapshot is complete
+// or an error occurs, then waits for the abort request. The error is reported
+// by Wait.
+func (s *Snapshot) generate(root common.Hash, marker []byte, abort chan chan struct{}) {
+	var (
+		batch = s.diskdb.NewBatch()
+		last  []byte
+	)
+	// flush writes the batch along with the progress marker out to disk and
+	// makes the generated entries visible.
+	flush := func(done bool) error {
+		var err error
+		if done {
+			err = batch.Delete(snapshotGeneratorKey)
+		} else if last != nil {
+			err = batch.Put(snapshotGeneratorKey, append([]byte{0}, last...))
+		}
+		if err != nil {
+			return err
+		}
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		if err := batch.Submit(); err != nil {
+			return err
+		}
+		batch.Reset()
+		if done {
+			s.genMarker = nil
+		} else if last != nil {
+			s.genMarker = last
+		}
+		return nil
+	}
+	// fail records the generation error and releases the waiters
+	fail := func(err error) {
+		s.lock.Lock()
+		s.genErr = err
+		s.lock.Unlock()
+		close(s.genDone)
+	}
+	var start []byte
+	if len(marker) > 0 {
+		start = append(common.CopyBytes(marker), 0)
+	}
+	trie, err := New(StateTrieID(root), s.triedb)
+	if err == nil {
+		it := trie.Iterator(start)
+		for it.Next() {
+			// Interrupt the generation if it's requested
+			select {
+			case stop := <-abort:
+				if err := flush(false); err != nil {
+					fail(err)
+				}
+				close(stop)
+				return
+			default:
+			}
+			hash := common.BytesToHash(it.Key)
+			if err = s.generateAccount(batch, root, hash, it.Value); err != nil {
+				break
+			}
+			last = hash[:]
+			if batch.ValueSize() >= accdb.IdealBatchSize {
+				if err = flush(false); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil {
+			err = it.Err
+		}
+	}
+	if err == nil {
+		err = flush(true)
+	}
+	if err == nil {
+		close(s.genDone)
+	} else {
+		// Persist the progress made so far, the generation failed anyway
+		flush(false)
+		fail(err)
+	}
+	// Someone will be looking for us, wait it out
+	close(<-abort)
+}
+
+// generateAccount writes the given account along with all the slots of its
+// storage trie into the batch.
+func (s *Snapshot) generateAccount(batch accdb.Batch, root common.Hash, hash common.Hash, value []byte) error {
+	if err := batch.Put(accountSnapshotKey(hash), value); err != nil {
+		return err
+	}
+	var account types.StateAccount
+	if err := rlp.DecodeBytes(value, &account); err != nil || account.Root == emptyRoot || account.Root == (common.Hash{}) {
+		return nil
+	}
+	trie, err := New(StorageTrieID(root, hash, account.Root), s.triedb)
+	if err != nil {
+		return err
+	}
+	it := trie.Iterator(nil)
+	for it.Next() {
+		if err := batch.Put(storageSnapshotKey(hash, common.BytesToHash(it.Key)), it.Value); err != nil {
+			return err
+		}
+	}
+	return it.Err
+}
+
+// Verify recomputes the state root from the snapshot entries and checks that
+// it matches the root the snapshot belongs to. The storage roots of all the
+// accounts are verified as well.
+func (s *Snapshot) Verify() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.genMarker != nil {
+		return ErrNotConstructed
+	}
+	accTrie := NewStackTrie(nil)
+	it := s.diskdb.NewIterator(snapshotAccountPrefix, nil)
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(snapshotAccountPrefix)+common.HashLength {
+			continue
+		}
+		hash := common.BytesToHash(key[len(snapshotAccountPrefix):])
+		if err := accTrie.TryUpdate(hash[:], common.CopyBytes(it.Value())); err != nil {
+			return err
+		}
+		var account types.StateAccount
+		if err := rlp.DecodeBytes(it.Value(), &account); err != nil || account.Root == (common.Hash{}) {
+			continue
+		}
+		if root := s.storageRoot(hash); root != account.Root {
+			return fmt.Errorf("storage root mismatch of account %x: have %x, want %x", hash, root, account.Root)
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	if root := accTrie.Hash(); root != s.root {
+		return fmt.Errorf("state root mismatch: have %x, want %x", root, s.root)
+	}
+	return nil
+}
+
+// storageRoot recomputes the storage root of the given account from the
+// snapshot entries.
+func (s *Snapshot) storageRoot(account common.Hash) common.Hash {
+	prefix := storageSnapshotPrefix(account)
+	it := s.diskdb.NewIterator(prefix, nil)
+	defer it.Release()
+
+	stTrie := NewStackTrieWithOwner(nil, account)
+	for it.Next() {
+		stTrie.Update(it.Key()[len(prefix):], common.CopyBytes(it.Value()))
+	}
+	return stTrie.Hash()
+}
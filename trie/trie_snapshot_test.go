@@ -0,0 +1,350 @@
+package trie
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+	"testing"
+
+	"github.com/jaiminpan/mt-trie/common"
+	"github.com/jaiminpan/mt-trie/crypto"
+	"github.com/jaiminpan/mt-trie/rlp"
+	"github.com/jaiminpan/mt-trie/types"
+)
+
+// updateState applies the given account and storage changes, keyed by hashed
+// keys, on top of the parent state and flushes the new state to disk. Nil
+// accounts are deleted, the accounts owning changed storage must be present.
+// The flat account changes are returned along with the new root.
+func updateState(t *testing.T, db *TrieDB, parent common.Hash, accounts map[common.Hash]*types.StateAccount, storage map[common.Hash]map[common.Hash][]byte) (common.Hash, map[common.Hash][]byte) {
+	accTrie, err := New(StateTrieID(parent), db)
+	if err != nil {
+		t.Fatalf("Failed to open state %x: %v", parent, err)
+	}
+	merged := NewMergedNodeSet()
+	for owner, slots := range storage {
+		root := emptyRoot
+		if blob, _ := accTrie.TryGet(owner[:]); len(blob) != 0 {
+			var prev types.StateAccount
+			if err := rlp.DecodeBytes(blob, &prev); err != nil {
+				t.Fatalf("Failed to decode account: %v", err)
+			}
+			root = prev.Root
+		}
+		stTrie, err := New(StorageTrieID(parent, owner, root), db)
+		if err != nil {
+			t.Fatalf("Failed to open storage %x: %v", root, err)
+		}
+		for hash, value := range slots {
+			if len(value) == 0 {
+				stTrie.Delete(hash[:])
+			} else {
+				stTrie.Update(hash[:], value)
+			}
+		}
+		root, nodes, _ := stTrie.Commit(false)
+		if nodes != nil {
+			merged.Merge(nodes)
+		}
+		accounts[owner].Root = root
+	}
+	flat := make(map[common.Hash][]byte)
+	for hash, account := range accounts {
+		if account == nil {
+			accTrie.Delete(hash[:])
+			flat[hash] = nil
+			continue
+		}
+		blob, _ := rlp.EncodeToBytes(account)
+		accTrie.Update(hash[:], blob)
+		flat[hash] = blob
+	}
+	root, nodes, _ := accTrie.Commit(true)
+	if nodes != nil {
+		merged.Merge(nodes)
+	}
+	if err := db.Update(root, parent, merged); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	if err := db.Commit(root); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	return root, flat
+}
+
+func TestSnapshot(t *testing.T) {
+	diskdb := NewMemoryDatabase()
+	db := NewTrieDB(diskdb)
+
+	// Create a state with a few accounts owning storage
+	var (
+		hashes   []common.Hash
+		owners   []common.Hash
+		accounts = make(map[common.Hash]*types.StateAccount)
+		storage  = make(map[common.Hash]map[common.Hash][]byte)
+	)
+	for i := 0; i < 64; i++ {
+		hash := common.BytesToHash(randBytes(32))
+		hashes = append(hashes, hash)
+		accounts[hash] = &types.StateAccount{Balance: big.NewInt(int64(i + 1)), Root: emptyRoot}
+		if i < 8 {
+			owners = append(owners, hash)
+			storage[hash] = make(map[common.Hash][]byte)
+			for j := 0; j < 10; j++ {
+				storage[hash][common.BytesToHash(randBytes(32))] = randBytes(20)
+			}
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i][:], hashes[j][:]) < 0 })
+	root, flat := updateState(t, db, emptyRoot, accounts, storage)
+
+	snap, err := NewSnapshot(diskdb, db, root)
+	if err != nil {
+		t.Fatalf("Failed to create snapshot: %v", err)
+	}
+	if err := snap.Wait(); err != nil {
+		t.Fatalf("Failed to generate snapshot: %v", err)
+	}
+	if err := snap.Verify(); err != nil {
+		t.Fatalf("Failed to verify generated snapshot: %v", err)
+	}
+	for hash, blob := range flat {
+		if have, err := snap.Account(hash); err != nil || !bytes.Equal(have, blob) {
+			t.Fatalf("Account mismatch %x: have %x, want %x, err %v", hash, have, blob, err)
+		}
+	}
+	for owner, slots := range storage {
+		for hash, value := range slots {
+			if have, err := snap.Storage(owner, hash); err != nil || !bytes.Equal(have, value) {
+				t.Fatalf("Storage mismatch %x/%x: have %x, want %x, err %v", owner, hash, have, value, err)
+			}
+		}
+	}
+	// Move the snapshot forward: change and delete slots, delete an account
+	// along with its storage and create a new account.
+	var (
+		owner, deleted, created = owners[0], owners[1], common.BytesToHash(randBytes(32))
+		changed, dropped, wiped common.Hash
+	)
+	for hash := range storage[deleted] {
+		wiped = hash
+	}
+	for hash := range storage[owner] {
+		if changed == (common.Hash{}) {
+			changed = hash
+		} else if dropped == (common.Hash{}) {
+			dropped = hash
+		}
+	}
+	accounts = map[common.Hash]*types.StateAccount{
+		owner:   {Balance: big.NewInt(100)},
+		deleted: nil,
+		created: {Balance: big.NewInt(200)},
+	}
+	storage = map[common.Hash]map[common.Hash][]byte{
+		owner:   {changed: []byte{0x1}, dropped: nil},
+		created: {common.BytesToHash(randBytes(32)): []byte{0x2}},
+	}
+	root2, flat := updateState(t, db, root, accounts, storage)
+	if err := snap.Update(root2, common.Hash{0x1}, flat, storage); err == nil {
+		t.Fatal("Expected error updating from a wrong parent")
+	}
+	if err := snap.Update(root2, root, flat, storage); err != nil {
+		t.Fatalf("Failed to update snapshot: %v", err)
+	}
+	if err := snap.Verify(); err != nil {
+		t.Fatalf("Failed to verify updated snapshot: %v", err)
+	}
+	if blob, _ := snap.Storage(owner, changed); !bytes.Equal(blob, []byte{0x1}) {
+		t.Fatalf("Unexpected changed slot: %x", blob)
+	}
+	if blob, _ := snap.Storage(owner, dropped); blob != nil {
+		t.Fatalf("Unexpected deleted slot: %x", blob)
+	}
+	if blob, _ := snap.Account(deleted); blob != nil {
+		t.Fatalf("Unexpected deleted account: %x", blob)
+	}
+	if blob, _ := snap.Storage(deleted, wiped); blob != nil {
+		t.Fatalf("Unexpected slot of deleted account: %x", blob)
+	}
+	snap.Close()
+
+	// Reopening the complete snapshot doesn't need any generation
+	snap, _ = NewSnapshot(diskdb, db, root2)
+	if !snap.Generated() {
+		t.Fatal("Persisted snapshot is not reused")
+	}
+	snap.Close()
+
+	// Interrupted generation is resumed from the persisted marker, the
+	// entries not generated yet are not served.
+	batch := diskdb.NewBatch()
+	batch.Put(snapshotGeneratorKey, append([]byte{0}, hashes[31][:]...))
+	for _, hash := range hashes[32:] {
+		batch.Delete(accountSnapshotKey(hash))
+	}
+	batch.Submit()
+
+	partial := &Snapshot{diskdb: diskdb, root: root2, genMarker: hashes[31][:]}
+	if _, err := partial.Account(hashes[32]); err != ErrNotCoveredYet {
+		t.Fatalf("Expected not covered error, got %v", err)
+	}
+	if _, err := partial.Account(hashes[31]); err != nil {
+		t.Fatalf("Failed to retrieve generated account: %v", err)
+	}
+	if err := partial.Verify(); err != ErrNotConstructed {
+		t.Fatalf("Expected not constructed error, got %v", err)
+	}
+	snap, _ = NewSnapshot(diskdb, db, root2)
+	if err := snap.Wait(); err != nil {
+		t.Fatalf("Failed to resume snapshot generation: %v", err)
+	}
+	if err := snap.Verify(); err != nil {
+		t.Fatalf("Failed to verify resumed snapshot: %v", err)
+	}
+	snap.Close()
+
+	// Opening another root regenerates the snapshot from scratch
+	snap, _ = NewSnapshot(diskdb, db, root)
+	if err := snap.Wait(); err != nil {
+		t.Fatalf("Failed to regenerate snapshot: %v", err)
+	}
+	if err := snap.Verify(); err != nil {
+		t.Fatalf("Failed to verify regenerated snapshot: %v", err)
+	}
+	if blob, _ := snap.Account(created); blob != nil {
+		t.Fatalf("Unexpected account of another state: %x", blob)
+	}
+	snap.Close()
+
+	// Corrupted entries are detected by the verifier
+	batch.Reset()
+	batch.Put(accountSnapshotKey(hashes[5]), []byte{0x1})
+	batch.Submit()
+	if err := snap.Verify(); err == nil {
+		t.Fatal("Expected corrupted snapshot to fail verification")
+	}
+}
+
+func TestSnapshotGenerationFailure(t *testing.T) {
+	diskdb := NewMemoryDatabase()
+	db := NewTrieDB(diskdb)
+
+	// The trie of the root is missing, the generation fails right away
+	snap, err := NewSnapshot(diskdb, db, common.HexToHash("0x01"))
+	if err != nil {
+		t.Fatalf("Failed to create snapshot: %v", err)
+	}
+	if err := snap.Wait(); err == nil {
+		t.Fatal("Expected generation error")
+	}
+	if snap.Generated() {
+		t.Fatal("Failed snapshot reported as generated")
+	}
+	if _, err := snap.Account(common.HexToHash("0x02")); err != ErrNotCoveredYet {
+		t.Fatalf("Expected not covered error, got %v", err)
+	}
+	snap.Close()
+}
+
+func TestSnapshotStateTrie(t *testing.T) {
+	diskdb := NewMemoryDatabase()
+	db := NewTrieDB(diskdb)
+
+	keccak := func(blob []byte) common.Hash {
+		return common.BytesToHash(crypto.HashData(crypto.NewKeccakState(), blob, make([]byte, common.HashLength)))
+	}
+	var (
+		addrs    []common.Address
+		owner    = common.BytesToAddress(randBytes(20))
+		slot     = randBytes(32)
+		accounts = map[common.Hash]*types.StateAccount{keccak(owner[:]): {Balance: big.NewInt(1)}}
+		storage  = map[common.Hash]map[common.Hash][]byte{keccak(owner[:]): {keccak(slot): []byte{0x1}}}
+	)
+	for i := 0; i < 16; i++ {
+		addr := common.BytesToAddress(randBytes(20))
+		addrs = append(addrs, addr)
+		accounts[keccak(addr[:])] = &types.StateAccount{Balance: big.NewInt(int64(i + 2)), Root: emptyRoot}
+	}
+	root, _ := updateState(t, db, emptyRoot, accounts, storage)
+
+	snap, _ := NewSnapshot(diskdb, db, root)
+	if err := snap.Wait(); err != nil {
+		t.Fatalf("Failed to generate snapshot: %v", err)
+	}
+	defer snap.Close()
+
+	// Forge the snapshot entries of an account and a slot, the reads served
+	// from the snapshot return the forged values.
+	forged, _ := rlp.EncodeToBytes(&types.StateAccount{Balance: big.NewInt(1000), Root: emptyRoot})
+	diskdb.Put(accountSnapshotKey(keccak(addrs[0][:])), forged)
+	diskdb.Put(storageSnapshotKey(keccak(owner[:]), keccak(slot)), []byte{0x2})
+
+	accTrie, _ := NewStateTrie(StateTrieID(root), db)
+	accTrie.UseSnapshot(snap)
+	balance := func(tr *StateTrie, addr common.Address) int64 {
+		account, err := tr.GetAccount(addr)
+		if err != nil || account == nil {
+			t.Fatalf("Failed to retrieve account %x: %v", addr, err)
+		}
+		return account.Balance.Int64()
+	}
+	if have := balance(accTrie, addrs[0]); have != 1000 {
+		t.Fatalf("Account not served from snapshot: balance %d", have)
+	}
+	if have := balance(accTrie, addrs[1]); have != 3 {
+		t.Fatalf("Unexpected account balance: have %d, want 3", have)
+	}
+	account, _ := accTrie.GetAccount(owner)
+	stTrie, _ := NewStateTrie(StorageTrieID(root, keccak(owner[:]), account.Root), db)
+	stTrie.UseSnapshot(snap)
+	if blob, _ := stTrie.TryGet(slot); !bytes.Equal(blob, []byte{0x2}) {
+		t.Fatalf("Slot not served from snapshot: %x", blob)
+	}
+	// The reads are resolved through the trie while the witness is collected,
+	// so that they can be re-executed on the witness.
+	witTrie, _ := NewStateTrie(StateTrieID(root), db)
+	witTrie.UseSnapshot(snap)
+	witTrie.EnableWitness()
+	if have := balance(witTrie, addrs[1]); have != 3 {
+		t.Fatalf("Unexpected account balance: have %d, want 3", have)
+	}
+	verifier, err := NewStateTrie(StateTrieID(root), NewWitnessDB(witTrie.Witness()))
+	if err != nil {
+		t.Fatalf("Failed to open trie on witness: %v", err)
+	}
+	if have := balance(verifier, addrs[1]); have != 3 {
+		t.Fatalf("Unexpected account balance on witness: have %d, want 3", have)
+	}
+	if have := balance(witTrie, addrs[0]); have != 2 {
+		t.Fatalf("Witnessed read served from snapshot: balance %d", have)
+	}
+
+	// The entries not covered by the snapshot are read from the trie.
+	snap.lock.Lock()
+	snap.genMarker = []byte{}
+	snap.lock.Unlock()
+	if have := balance(accTrie, addrs[0]); have != 2 {
+		t.Fatalf("Uncovered account served from snapshot: balance %d", have)
+	}
+	snap.lock.Lock()
+	snap.genMarker = nil
+	snap.lock.Unlock()
+
+	// The modified trie doesn't use the snapshot anymore.
+	if err := accTrie.UpdateAccount(addrs[1], &types.StateAccount{Balance: big.NewInt(5), Root: emptyRoot}); err != nil {
+		t.Fatalf("Failed to update account: %v", err)
+	}
+	if have := balance(accTrie, addrs[0]); have != 2 {
+		t.Fatalf("Modified trie served from snapshot: balance %d", have)
+	}
+	// The tries of other states don't use the snapshot either.
+	root2, _ := updateState(t, db, root, map[common.Hash]*types.StateAccount{
+		keccak(addrs[1][:]): {Balance: big.NewInt(5), Root: emptyRoot},
+	}, nil)
+	accTrie, _ = NewStateTrie(StateTrieID(root2), db)
+	accTrie.UseSnapshot(snap)
+	if have := balance(accTrie, addrs[0]); have != 2 {
+		t.Fatalf("Stale snapshot served: balance %d", have)
+	}
+}
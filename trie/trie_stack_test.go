@@ -0,0 +1,91 @@
+package trie
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jaiminpan/mt-trie/common"
+)
+
+func TestStackTrieHash(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 16, 100, 1000} {
+		trie, vals := randomTrie(n)
+		st := NewStackTrie(nil)
+		for _, kv := range sortedEntries(vals) {
+			st.Update(kv.k, kv.v)
+		}
+		if have, want := st.Hash(), trie.Hash(); have != want {
+			t.Fatalf("%d entries: root mismatch: have %x, want %x", n, have, want)
+		}
+	}
+}
+
+func TestStackTrieShortValues(t *testing.T) {
+	// Small keys and values produce nodes embedded into their parents,
+	// including a root node shorter than 32 bytes.
+	keys := [][]byte{{0x00, 0x00}, {0x00, 0x01}, {0x01, 0x00}, {0x10, 0x00}, {0x10, 0x01}}
+	for i := 1; i <= len(keys); i++ {
+		trie := NewEmpty(NewTrieDB(NewMemoryDatabase()))
+		st := NewStackTrie(nil)
+		for _, key := range keys[:i] {
+			trie.Update(key, []byte{0x1})
+			st.Update(key, []byte{0x1})
+		}
+		if have, want := st.Hash(), trie.Hash(); have != want {
+			t.Fatalf("%d keys: root mismatch: have %x, want %x", i, have, want)
+		}
+	}
+}
+
+func TestStackTrieCommit(t *testing.T) {
+	trie, vals := randomTrie(2000)
+	root := trie.Hash()
+
+	// Flush the emitted nodes straight to disk and ensure a regular trie
+	// opened on top of them contains all the entries.
+	diskdb := NewMemoryDatabase()
+	batch := diskdb.NewBatch()
+	st := NewStackTrie(func(owner common.Hash, path []byte, hash common.Hash, blob []byte) {
+		batch.Put(hash[:], common.CopyBytes(blob))
+	})
+	for _, kv := range sortedEntries(vals) {
+		st.Update(kv.k, kv.v)
+	}
+	have, err := st.Commit()
+	if err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if have != root {
+		t.Fatalf("Root mismatch: have %x, want %x", have, root)
+	}
+	if err := batch.Submit(); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	trie, err = New(TrieID(root), NewTrieDB(diskdb))
+	if err != nil {
+		t.Fatalf("Failed to open trie: %v", err)
+	}
+	for _, kv := range vals {
+		if v := trie.Get(kv.k); !bytes.Equal(v, kv.v) {
+			t.Fatalf("Value mismatch for %x: have %x, want %x", kv.k, v, kv.v)
+		}
+	}
+	if _, err := NewStackTrie(nil).Commit(); err != ErrCommitDisabled {
+		t.Fatalf("Expected commit disabled error, got %v", err)
+	}
+}
+
+func TestStackTrieKeyOrder(t *testing.T) {
+	st := NewStackTrie(nil)
+	if err := st.TryUpdate([]byte{0x02}, []byte{0x1}); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	for _, key := range [][]byte{{0x01}, {0x02}, {0x02, 0x01}} {
+		if err := st.TryUpdate(key, []byte{0x1}); err == nil {
+			t.Fatalf("Expected error for key %x", key)
+		}
+	}
+	if err := st.TryUpdate([]byte{0x03}, nil); err == nil {
+		t.Fatal("Expected error for deletion")
+	}
+}
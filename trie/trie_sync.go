@@ -0,0 +1,386 @@
+package trie
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+
+	"github.com/jaiminpan/mt-trie/accdb"
+	"github.com/jaiminpan/mt-trie/common"
+)
+
+// ErrNotRequested is returned by the trie sync when it's requested to process a
+// node it did not request.
+var ErrNotRequested = errors.New("not requested")
+
+// ErrAlreadyProcessed is returned by the trie sync when it's requested to process a
+// node it already processed previously.
+var ErrAlreadyProcessed = errors.New("already processed")
+
+// ErrHashMismatch is returned by the trie sync when the delivered node data
+// doesn't match the requested node hash. The node is rescheduled for retrieval.
+var ErrHashMismatch = errors.New("node hash mismatch")
+
+// maxFetchesPerDepth is the maximum number of pending trie nodes per depth. The
+// role of this value is to limit the number of trie nodes that get expanded in
+// memory if the node was configured with a significant number of peers.
+const maxFetchesPerDepth = 16384
+
+// LeafCallback is a callback type invoked when a trie operation reaches a leaf
+// node.
+//
+// The keys is a path tuple identifying a particular trie node either in a single
+// trie (account) or a layered trie (account -> storage). Each key in the tuple
+// is in the raw format(32 bytes).
+//
+// The path is a composite hexary path identifying the trie node. All the key
+// bytes are converted to the hexary nibbles and composited with the parent path
+// if the trie node is in a layered trie.
+//
+// It's used by state sync and commit to allow handling external references
+// between account and storage tries.
+type LeafCallback func(keys [][]byte, path []byte, leaf []byte, parent common.Hash, parentPath []byte) error
+
+// nodeRequest represents a scheduled or already in-flight trie node retrieval request.
+type nodeRequest struct {
+	hash common.Hash // Hash of the trie node to retrieve
+	path []byte      // Merkle path leading to this node for prioritization
+	data []byte      // Data content of the node, cached until all subtrees complete
+
+	parent   *nodeRequest // Parent state node referencing this entry
+	deps     int          // Number of dependencies before allowed to commit this node
+	callback LeafCallback // Callback to invoke if a leaf node it reached on this branch
+}
+
+// SyncResult is a response with requested trie node along with its node path.
+type SyncResult struct {
+	Path string // Path of the originally unknown trie node
+	Data []byte // Data content of the retrieved trie node
+}
+
+// syncMemBatch is an in-memory buffer of successfully downloaded but not yet
+// persisted data items.
+type syncMemBatch struct {
+	nodes  map[string][]byte      // In-memory membatch of recently completed nodes
+	hashes map[string]common.Hash // Hashes of recently completed nodes
+	size   uint64                 // Estimated batch-size of in-memory data.
+}
+
+// newSyncMemBatch allocates a new memory-buffer for not-yet persisted trie nodes.
+func newSyncMemBatch() *syncMemBatch {
+	return &syncMemBatch{
+		nodes:  make(map[string][]byte),
+		hashes: make(map[string]common.Hash),
+	}
+}
+
+// hasNode reports the trie node with specific path is already cached.
+func (batch *syncMemBatch) hasNode(path []byte) bool {
+	_, ok := batch.nodes[string(path)]
+	return ok
+}
+
+// Sync is the main state trie synchronisation scheduler, which provides yet
+// unknown trie hashes to retrieve, accepts node data associated with said hashes
+// and reconstructs the trie step by step until all is done. The retrieval of
+// the nodes is left to the caller, which is free to fetch them from any source
+// (e.g. a remote peer).
+type Sync struct {
+	scheme   string                  // Node storage scheme of the persistent database
+	database accdb.KeyValueReader    // Persistent database to check for existing entries
+	membatch *syncMemBatch           // Memory buffer to avoid frequent database writes
+	nodeReqs map[string]*nodeRequest // Pending requests pertaining to a trie node path
+	queue    *syncQueue              // Priority queue with the pending requests
+	fetches  map[int]int             // Number of active fetches per trie node depth
+}
+
+// NewSync creates a new trie data download scheduler. The scheme specifies how
+// the nodes are stored in the database, HashScheme or PathScheme.
+func NewSync(root common.Hash, database accdb.KeyValueReader, callback LeafCallback, scheme string) *Sync {
+	ts := &Sync{
+		scheme:   scheme,
+		database: database,
+		membatch: newSyncMemBatch(),
+		nodeReqs: make(map[string]*nodeRequest),
+		queue:    new(syncQueue),
+		fetches:  make(map[int]int),
+	}
+	ts.AddSubTrie(root, nil, common.Hash{}, nil, callback)
+	return ts
+}
+
+// AddSubTrie registers a new trie to the sync code, rooted at the designated
+// parent for completion tracking. The given path is a unique node path in
+// hex format and contain all the parent path if it's layered trie node.
+func (s *Sync) AddSubTrie(root common.Hash, path []byte, parent common.Hash, parentPath []byte, callback LeafCallback) {
+	// Short circuit if the trie is empty or already known
+	if root == emptyRoot {
+		return
+	}
+	if s.membatch.hasNode(path) {
+		return
+	}
+	owner, inner := ResolvePath(path)
+	if hasTrieNode(s.database, owner, inner, root, s.scheme) {
+		return
+	}
+	// Assemble the new sub-trie sync request
+	req := &nodeRequest{
+		hash:     root,
+		path:     path,
+		callback: callback,
+	}
+	// If this sub-trie has a designated parent, link them together
+	if parent != (common.Hash{}) {
+		ancestor := s.nodeReqs[string(parentPath)]
+		if ancestor == nil {
+			panic(fmt.Sprintf("sub-trie ancestor not found: %x", parent))
+		}
+		ancestor.deps++
+		req.parent = ancestor
+	}
+	s.scheduleNodeRequest(req)
+}
+
+// Missing retrieves the known missing nodes from the trie for retrieval. The
+// paths of the trie nodes are returned along with the hashes, the path is the
+// identifier of the request to be used in the delivered SyncResult.
+// A max of zero means no limit.
+func (s *Sync) Missing(max int) ([]string, []common.Hash) {
+	var (
+		nodePaths  []string
+		nodeHashes []common.Hash
+	)
+	for s.queue.Len() > 0 && (max == 0 || len(nodeHashes) < max) {
+		// Retrieve the next item in line
+		item := s.queue.peek()
+
+		// If we have too many already-pending tasks for this depth, throttle
+		depth := int(item.prio >> 56)
+		if s.fetches[depth] > maxFetchesPerDepth {
+			break
+		}
+		// Item is allowed to be scheduled, add it to the task list
+		heap.Pop(s.queue)
+		s.fetches[depth]++
+
+		req, ok := s.nodeReqs[item.path]
+		if !ok {
+			continue
+		}
+		nodePaths = append(nodePaths, item.path)
+		nodeHashes = append(nodeHashes, req.hash)
+	}
+	return nodePaths, nodeHashes
+}
+
+// Process injects the received data for requested item. The data is verified
+// against the requested hash first, invalid data is rejected with
+// ErrHashMismatch and the node is handed out again by Missing. Once all the
+// children of a node are retrieved, the node is moved into the membatch.
+func (s *Sync) Process(result SyncResult) error {
+	// If the trie node was not requested or it's already processed, bail out
+	req := s.nodeReqs[result.Path]
+	if req == nil {
+		return ErrNotRequested
+	}
+	if req.data != nil {
+		return ErrAlreadyProcessed
+	}
+	// Verify the delivered data, reschedule the request if it's invalid
+	h := newHasher(false)
+	hash := common.BytesToHash(h.hashData(result.Data))
+	returnHasherToPool(h)
+
+	if hash != req.hash {
+		s.fetches[len(req.path)]--
+		s.scheduleNodeRequest(req)
+		return ErrHashMismatch
+	}
+	// Decode the node data content and update the request
+	node, err := decodeNode(req.hash[:], result.Data)
+	if err != nil {
+		return err
+	}
+	req.data = result.Data
+
+	// Create and schedule a request for all the children nodes
+	requests, err := s.children(req, node)
+	if err != nil {
+		return err
+	}
+	if len(requests) == 0 && req.deps == 0 {
+		s.commitNodeRequest(req)
+	} else {
+		req.deps += len(requests)
+		for _, child := range requests {
+			s.scheduleNodeRequest(child)
+		}
+	}
+	return nil
+}
+
+// Commit flushes the data stored in the internal membatch out to persistent
+// storage according to the node storage scheme, returning any occurred error.
+func (s *Sync) Commit(dbw accdb.Batch) error {
+	// Dump the membatch into a database dbw
+	for path, value := range s.membatch.nodes {
+		owner, inner := ResolvePath([]byte(path))
+		if err := writeTrieNode(dbw, owner, inner, s.membatch.hashes[path], value, s.scheme); err != nil {
+			return err
+		}
+	}
+	// Drop the membatch data and return
+	s.membatch = newSyncMemBatch()
+	return nil
+}
+
+// MemSize returns an estimated size (in bytes) of the data held in the membatch.
+func (s *Sync) MemSize() uint64 {
+	return s.membatch.size
+}
+
+// Pending returns the number of state entries currently pending for download.
+func (s *Sync) Pending() int {
+	return len(s.nodeReqs)
+}
+
+// scheduleNodeRequest inserts a new state retrieval request into the fetch queue.
+func (s *Sync) scheduleNodeRequest(req *nodeRequest) {
+	s.nodeReqs[string(req.path)] = req
+
+	// Schedule the request for future retrieval, deeper nodes first so
+	// that the subtries are completed and flushed as soon as possible.
+	prio := int64(len(req.path)) << 56 // depth >= 128 will never happen, storage leaves will be included in their parents
+	for i := 0; i < 14 && i < len(req.path); i++ {
+		prio |= int64(15-req.path[i]) << (52 - i*4) // 15-nibble => lexicographic order
+	}
+	heap.Push(s.queue, &syncQueueItem{path: string(req.path), prio: prio})
+}
+
+// children retrieves all the missing children of a state trie entry for future
+// retrieval scheduling.
+func (s *Sync) children(req *nodeRequest, object node) ([]*nodeRequest, error) {
+	// Gather all the children of the node, irrelevant whether known or not
+	type childNode struct {
+		path []byte
+		node node
+	}
+	var children []childNode
+
+	switch node := (object).(type) {
+	case *shortNode:
+		key := node.Key
+		if hasTerm(key) {
+			key = key[:len(key)-1]
+		}
+		children = []childNode{{
+			node: node.Val,
+			path: append(append([]byte(nil), req.path...), key...),
+		}}
+	case *fullNode:
+		for i := 0; i < 17; i++ {
+			if node.Children[i] != nil {
+				children = append(children, childNode{
+					node: node.Children[i],
+					path: append(append([]byte(nil), req.path...), byte(i)),
+				})
+			}
+		}
+	default:
+		panic(fmt.Sprintf("unknown node: %+v", node))
+	}
+	// Iterate over the children, and request all unknown ones
+	requests := make([]*nodeRequest, 0, len(children))
+	for _, child := range children {
+		// Notify any external watcher of a new key/value node
+		if req.callback != nil {
+			if node, ok := (child.node).(valueNode); ok {
+				var paths [][]byte
+				if len(child.path) == 2*common.HashLength {
+					paths = append(paths, hexToKeybytes(child.path))
+				} else if len(child.path) == 4*common.HashLength {
+					paths = append(paths, hexToKeybytes(child.path[:2*common.HashLength]))
+					paths = append(paths, hexToKeybytes(child.path[2*common.HashLength:]))
+				}
+				if err := req.callback(paths, child.path, node, req.hash, req.path); err != nil {
+					return nil, err
+				}
+			}
+		}
+		// If the child references another node, resolve or schedule
+		if node, ok := (child.node).(hashNode); ok {
+			// Try to resolve the node from the local database
+			if s.membatch.hasNode(child.path) {
+				continue
+			}
+			var (
+				chash        = common.BytesToHash(node)
+				owner, inner = ResolvePath(child.path)
+			)
+			if hasTrieNode(s.database, owner, inner, chash, s.scheme) {
+				continue
+			}
+			// Locally unknown node, schedule for retrieval
+			requests = append(requests, &nodeRequest{
+				path:     child.path,
+				hash:     chash,
+				parent:   req,
+				callback: req.callback,
+			})
+		}
+	}
+	return requests, nil
+}
+
+// commitNodeRequest finalizes a retrieval request and stores it into the membatch. If any
+// of the referencing parent requests complete due to this commit, they are also
+// committed themselves.
+func (s *Sync) commitNodeRequest(req *nodeRequest) {
+	// Write the node content to the membatch
+	s.membatch.nodes[string(req.path)] = req.data
+	s.membatch.hashes[string(req.path)] = req.hash
+
+	// The size tracking refers to the db-batch, not the in-memory data.
+	// Therefore, we ignore the req.path, and account only for the hash+data
+	// which eventually is written to db.
+	s.membatch.size += common.HashLength + uint64(len(req.data))
+	delete(s.nodeReqs, string(req.path))
+	s.fetches[len(req.path)]--
+
+	// Check parent for completion
+	if req.parent != nil {
+		req.parent.deps--
+		if req.parent.deps == 0 {
+			s.commitNodeRequest(req.parent)
+		}
+	}
+}
+
+// syncQueueItem is a scheduled node retrieval in the sync queue.
+type syncQueueItem struct {
+	path string // Path of the requested node
+	prio int64  // Retrieval priority, deeper nodes first
+}
+
+// syncQueue is a priority queue of the scheduled node retrievals, the item
+// with the highest priority is retrieved first. It implements heap.Interface.
+type syncQueue []*syncQueueItem
+
+func (q syncQueue) Len() int            { return len(q) }
+func (q syncQueue) Less(i, j int) bool  { return q[i].prio > q[j].prio }
+func (q syncQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *syncQueue) Push(x interface{}) { *q = append(*q, x.(*syncQueueItem)) }
+
+func (q *syncQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
+
+// peek returns the item with the highest priority without removing it.
+func (q syncQueue) peek() *syncQueueItem {
+	return q[0]
+}
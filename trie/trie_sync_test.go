@@ -0,0 +1,169 @@
+package trie
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/jaiminpan/mt-trie/accdb"
+	"github.com/jaiminpan/mt-trie/common"
+	"github.com/jaiminpan/mt-trie/rlp"
+	"github.com/jaiminpan/mt-trie/types"
+)
+
+// syncTrie drives the sync scheduler with a local fetcher serving the nodes
+// from the source database until the trie is complete.
+func syncTrie(t *testing.T, sched *Sync, src *TrieDB, dst accdb.KeyValueStore, count int) {
+	for {
+		paths, hashes := sched.Missing(count)
+		if len(paths) == 0 {
+			break
+		}
+		for i, path := range paths {
+			owner, inner := ResolvePath([]byte(path))
+			data, err := src.NodeBlob(owner, inner, hashes[i])
+			if err != nil || len(data) == 0 {
+				t.Fatalf("Failed to retrieve node %x: %v", hashes[i], err)
+			}
+			if err := sched.Process(SyncResult{Path: path, Data: data}); err != nil {
+				t.Fatalf("Failed to process result %x: %v", hashes[i], err)
+			}
+		}
+		batch := dst.NewBatch()
+		if err := sched.Commit(batch); err != nil {
+			t.Fatalf("Failed to commit data: %v", err)
+		}
+		batch.Submit()
+	}
+	if pending := sched.Pending(); pending != 0 {
+		t.Fatalf("Sync not complete: %d pending", pending)
+	}
+}
+
+func TestSync(t *testing.T) {
+	for _, scheme := range []string{HashScheme, PathScheme} {
+		config := &Config{Scheme: scheme}
+		src := NewTrieDBWithConfig(NewMemoryDatabase(), config)
+		trie, vals := randomTrie(1000)
+		trie.reader = src
+		root := commitTrie(trie, emptyRoot)
+
+		for _, count := range []int{1, 100, 0} {
+			dstDisk := NewMemoryDatabase()
+			syncTrie(t, NewSync(root, dstDisk, nil, scheme), src, dstDisk, count)
+
+			trie := mustOpen(t, NewTrieDBWithConfig(dstDisk, config), root)
+			for _, kv := range vals {
+				if v, err := trie.TryGet(kv.k); err != nil || !bytes.Equal(v, kv.v) {
+					t.Fatalf("%s batch %d: value mismatch for %x: have %x, want %x, err %v", scheme, count, kv.k, v, kv.v, err)
+				}
+			}
+			// A complete trie doesn't need any sync.
+			if paths, _ := NewSync(root, dstDisk, nil, scheme).Missing(0); len(paths) != 0 {
+				t.Fatalf("%s batch %d: synced trie reports %d missing nodes", scheme, count, len(paths))
+			}
+		}
+	}
+}
+
+func TestSyncInvalidData(t *testing.T) {
+	src := NewTrieDB(NewMemoryDatabase())
+	trie, _ := randomTrie(100)
+	trie.reader = src
+	root := commitTrie(trie, emptyRoot)
+
+	dstDisk := NewMemoryDatabase()
+	sched := NewSync(root, dstDisk, nil, HashScheme)
+	paths, hashes := sched.Missing(0)
+	if len(paths) != 1 || hashes[0] != root {
+		t.Fatalf("Unexpected initial request: %x", hashes)
+	}
+	if err := sched.Process(SyncResult{Path: "bogus", Data: []byte{0x1}}); err != ErrNotRequested {
+		t.Fatalf("Expected not requested error, got %v", err)
+	}
+	// Corrupt data is rejected, the node is requested again.
+	if err := sched.Process(SyncResult{Path: paths[0], Data: []byte{0xc0}}); err != ErrHashMismatch {
+		t.Fatalf("Expected hash mismatch error, got %v", err)
+	}
+	if again, _ := sched.Missing(0); len(again) != 1 || again[0] != paths[0] {
+		t.Fatalf("Invalid node not rescheduled: %x", again)
+	}
+	data := mustNodeBlob(t, src, root)
+	if err := sched.Process(SyncResult{Path: paths[0], Data: data}); err != nil {
+		t.Fatalf("Failed to process valid data: %v", err)
+	}
+	if err := sched.Process(SyncResult{Path: paths[0], Data: data}); err != ErrAlreadyProcessed {
+		t.Fatalf("Expected already processed error, got %v", err)
+	}
+	syncTrie(t, sched, src, dstDisk, 0)
+}
+
+func TestSyncStorageTries(t *testing.T) {
+	for _, scheme := range []string{HashScheme, PathScheme} {
+		testSyncStorageTries(t, scheme)
+	}
+}
+
+func testSyncStorageTries(t *testing.T, scheme string) {
+	// Create a state with a few accounts owning storage tries.
+	config := &Config{Scheme: scheme}
+	src := NewTrieDBWithConfig(NewMemoryDatabase(), config)
+	accTrie, _ := NewStateTrie(StateTrieID(emptyRoot), src)
+	merged := NewMergedNodeSet()
+	for i := byte(1); i <= 4; i++ {
+		addr := common.BytesToAddress([]byte{i})
+		owner := common.BytesToHash(accTrie.hashKey(addr[:]))
+		stTrie, _ := NewStateTrie(StorageTrieID(emptyRoot, owner, emptyRoot), src)
+		for j := 0; j < 20; j++ {
+			stTrie.Update(randBytes(32), randBytes(16))
+		}
+		root, nodes, _ := stTrie.Commit(false)
+		merged.Merge(nodes)
+		accTrie.UpdateAccount(addr, &types.StateAccount{Balance: big.NewInt(1), Root: root})
+	}
+	stateRoot, nodes, _ := accTrie.Commit(true)
+	merged.Merge(nodes)
+	src.Update(stateRoot, emptyRoot, merged)
+	src.Commit(stateRoot)
+
+	// Sync the account trie and schedule the storage tries from the leaves.
+	var (
+		dstDisk = NewMemoryDatabase()
+		sched   *Sync
+		owners  []common.Hash
+		roots   []common.Hash
+	)
+	callback := func(keys [][]byte, path []byte, leaf []byte, parent common.Hash, parentPath []byte) error {
+		var acc types.StateAccount
+		if err := rlp.DecodeBytes(leaf, &acc); err != nil {
+			return err
+		}
+		owners, roots = append(owners, common.BytesToHash(keys[0])), append(roots, acc.Root)
+		sched.AddSubTrie(acc.Root, path, parent, parentPath, nil)
+		return nil
+	}
+	sched = NewSync(stateRoot, dstDisk, callback, scheme)
+	syncTrie(t, sched, src, dstDisk, 10)
+
+	if len(roots) != 4 {
+		t.Fatalf("%s: unexpected number of storage tries: %d", scheme, len(roots))
+	}
+	// Every node of the source state is resolvable from the synced database.
+	dst := NewTrieDBWithConfig(dstDisk, config)
+	ids := []*ID{StateTrieID(stateRoot)}
+	for i := range roots {
+		ids = append(ids, StorageTrieID(stateRoot, owners[i], roots[i]))
+	}
+	for _, id := range ids {
+		trie, err := New(id, dst)
+		if err != nil {
+			t.Fatalf("%s: failed to open trie %x: %v", scheme, id.Root, err)
+		}
+		it := trie.NodeIterator(nil)
+		for it.Next(true) {
+		}
+		if it.Error() != nil {
+			t.Fatalf("%s: failed to iterate trie %x: %v", scheme, id.Root, it.Error())
+		}
+	}
+}
@@ -6,12 +6,27 @@ import (
 
 	"github.com/jaiminpan/mt-trie/accdb"
 	"github.com/jaiminpan/mt-trie/accdb/memorydb"
+	"github.com/jaiminpan/mt-trie/common"
 )
 
 func NewMemoryDatabase() accdb.KeyValueStore {
 	return memorydb.New()
 }
 
+// commitTrie commits the given trie opened at parent into its trie database
+// and flushes the committed nodes to disk, returning the new root hash.
+func commitTrie(trie *Trie, parent common.Hash) common.Hash {
+	db := trie.reader
+	root, nodes, _ := trie.Commit(false)
+	merged := NewMergedNodeSet()
+	if nodes != nil {
+		merged.Merge(nodes)
+	}
+	db.Update(root, parent, merged)
+	db.Commit(root)
+	return root
+}
+
 func TestEmptyTrie(t *testing.T) {
 	triedb := NewTrieDB(NewMemoryDatabase())
 	trie := NewEmpty(triedb)
@@ -44,7 +59,7 @@ func TestUpdate(t *testing.T) {
 	merged := NewMergedNodeSet()
 	merged.Merge(nodes)
 
-	triedb.Update(merged)
+	triedb.Update(root, emptyRoot, merged)
 	triedb.Commit(root)
 
 	trie, _ = New(TrieID(root), triedb)
@@ -65,58 +80,478 @@ func TestUpdate(t *testing.T) {
 	}
 }
 
-/*
-func TestRollback(t *testing.T) {
+func TestDelete(t *testing.T) {
+	trie := NewEmpty(NewTrieDB(NewMemoryDatabase()))
+	vals := []struct{ k, v string }{
+		{"do", "verb"},
+		{"ether", "wookiedoo"},
+		{"horse", "stallion"},
+		{"shaman", "horse"},
+		{"doge", "coin"},
+		{"ether", ""},
+		{"dog", "puppy"},
+		{"shaman", ""},
+	}
+	for _, val := range vals {
+		if val.v != "" {
+			trie.Update([]byte(val.k), []byte(val.v))
+		} else {
+			trie.Delete([]byte(val.k))
+		}
+	}
+	hash := trie.Hash()
+	exp := common.HexToHash("5991bb8c6514148a29db676a14ac506cd2cd5775ace63c30a4fe457715e9ac84")
+	if hash != exp {
+		t.Errorf("expected %x got %x", exp, hash)
+	}
+}
+
+func TestMissingNode(t *testing.T) {
+	diskdb := NewMemoryDatabase()
+	triedb := NewTrieDB(diskdb)
 
-	triedb := NewTrieDB(NewMemoryDatabase())
 	trie := NewEmpty(triedb)
+	trie.Update([]byte("120000"), []byte("qwerqwerqwerqwerqwerqwerqwerqwer"))
+	trie.Update([]byte("123456"), []byte("asdfasdfasdfasdfasdfasdfasdfasdf"))
+	root := commitTrie(trie, emptyRoot)
 
+	// Drop the branch node below the root, all the operations touching
+	// it must report the missing node and leave the trie untouched.
+	var branch common.Hash
+	trie, _ = New(TrieID(root), triedb)
+	for it := trie.NodeIterator(nil); it.Next(true); {
+		if it.Hash() != (common.Hash{}) && it.Hash() != root {
+			branch = it.Hash()
+			break
+		}
+	}
+	triedb.diskdb.(*memorydb.MemDB).Delete(branch[:])
+
+	trie, _ = New(TrieID(root), triedb)
+	if _, err := trie.TryGet([]byte("120000")); err == nil {
+		t.Error("expected error from TryGet")
+	} else if _, ok := err.(*MissingNodeError); !ok {
+		t.Errorf("expected MissingNodeError, got %v", err)
+	}
+	if err := trie.TryUpdate([]byte("120099"), []byte("zxcv")); err == nil {
+		t.Error("expected error from TryUpdate")
+	}
+	if err := trie.TryDelete([]byte("123456")); err == nil {
+		t.Error("expected error from TryDelete")
+	}
+	if hash := trie.Hash(); hash != root {
+		t.Errorf("root changed after failed operations: have %x, want %x", hash, root)
+	}
+}
+
+func TestCommitTracksChanges(t *testing.T) {
+	triedb := NewTrieDB(NewMemoryDatabase())
+	trie := NewEmpty(triedb)
 	trie.Update([]byte("120000"), []byte("qwerqwerqwerqwerqwerqwerqwerqwer"))
 	trie.Update([]byte("123456"), []byte("asdfasdfasdfasdfasdfasdfasdfasdf"))
-	root, nodes, _ := trie.Commit(false)
-	triedb.Update(NewWithNodeSet(nodes))
-	triedb.Commit(root)
+	root := commitTrie(trie, emptyRoot)
 
+	// Overwrite one value and delete the other one, the remaining leaf gets
+	// merged into the root so that the branch and both leaves are deleted.
 	trie, _ = New(TrieID(root), triedb)
-	_, err := trie.TryGet([]byte("120000"))
+	trie.Update([]byte("120000"), []byte("zxcvzxcvzxcvzxcvzxcvzxcvzxcvzxcv"))
+	trie.Delete([]byte("123456"))
+	_, nodes, err := trie.Commit(false)
 	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
+		t.Fatalf("Failed to commit trie: %v", err)
+	}
+	updated, deleted := nodes.Size()
+	if updated != 1 || deleted == 0 {
+		t.Fatalf("Unexpected nodeset size: updated %d, deleted %d", updated, deleted)
 	}
+	nodes.ForEachUpdated(func(path []byte, hash common.Hash, blob []byte, oldv []byte) {
+		if len(path) != 0 {
+			t.Errorf("Unexpected updated node at path %x", path)
+		}
+		if !bytes.Equal(oldv, mustNodeBlob(t, triedb, root)) {
+			t.Errorf("Unexpected previous value of the root node")
+		}
+	})
+	nodes.ForEachDeleted(func(path []byte, oldv []byte) {
+		if len(oldv) == 0 {
+			t.Errorf("Missing previous value of deleted node %x", path)
+		}
+	})
 
+	// Deleting all the entries must report the deletion of the root.
 	trie, _ = New(TrieID(root), triedb)
-	err = trie.TryUpdate([]byte("120099"), []byte("zxcvzxcvzxcvzxcvzxcvzxcvzxcvzxcv"))
-	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
+	trie.Delete([]byte("120000"))
+	trie.Delete([]byte("123456"))
+	hash, nodes, _ := trie.Commit(false)
+	if hash != emptyRoot {
+		t.Fatalf("Unexpected root of empty trie: %x", hash)
+	}
+	if nodes == nil {
+		t.Fatal("Missing nodeset of deletions")
+	}
+	if _, deleted := nodes.Size(); deleted == 0 {
+		t.Fatal("Missing deleted nodes")
 	}
+}
 
-	err = trie.TryUpdate([]byte("120000"), []byte("uiuiuiuiuiuiuiiuiui"))
-	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
+func mustNodeBlob(t *testing.T, db *TrieDB, hash common.Hash) []byte {
+	blob, err := db.NodeBlob(common.Hash{}, nil, hash)
+	if err != nil || len(blob) == 0 {
+		t.Fatalf("Missing node %x: %v", hash, err)
 	}
+	return blob
+}
 
-	err = trie.TryDelete([]byte("123456"))
-	if err != nil {
+func TestRollback(t *testing.T) {
+	diskdb := NewMemoryDatabase()
+	triedb := NewTrieDB(diskdb)
+
+	trie := NewEmpty(triedb)
+	trie.Update([]byte("120000"), []byte("qwerqwerqwerqwerqwerqwerqwerqwer"))
+	trie.Update([]byte("123456"), []byte("asdfasdfasdfasdfasdfasdfasdfasdf"))
+	root := commitTrie(trie, emptyRoot)
+
+	// Collect the nodes of the first state, they are pruned later on.
+	trie, _ = New(TrieID(root), triedb)
+	var stale []common.Hash
+	for it := trie.NodeIterator(nil); it.Next(true); {
+		if it.Hash() != (common.Hash{}) {
+			stale = append(stale, it.Hash())
+		}
+	}
+	trie, _ = New(TrieID(root), triedb)
+	if err := trie.TryUpdate([]byte("120099"), []byte("zxcvzxcvzxcvzxcvzxcvzxcvzxcvzxcv")); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := trie.TryUpdate([]byte("120000"), []byte("uiuiuiuiuiuiuiiuiui")); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := trie.TryDelete([]byte("123456")); err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
+	root2 := commitTrie(trie, root)
 
-	root2, nodes2, _ := trie.Commit(false)
-	triedb.Update(NewWithNodeSet(nodes2))
-	triedb.Commit(root2)
+	trie, _ = New(TrieID(root2), triedb)
+	trie.Update([]byte("123456"), []byte("hjklhjklhjklhjklhjklhjklhjklhjkl"))
+	root3, nodes, _ := trie.Commit(false)
+	merged := NewMergedNodeSet()
+	merged.Merge(nodes)
+	triedb.Update(root3, root2, merged)
 
-	trie, _ = New(TrieID(root), triedb)
+	// Prune the nodes of the first state, which can't be resolved anymore.
+	for _, hash := range stale {
+		diskdb.(*memorydb.MemDB).Delete(hash[:])
+	}
+	if _, err := New(TrieID(root), triedb); err == nil {
+		t.Fatal("Expected pruned state to be unavailable")
+	}
+	// Rolling back to the first state restores its nodes from the reverse diffs.
+	if err := triedb.Rollback(root); err != nil {
+		t.Fatalf("Failed to rollback: %v", err)
+	}
+	trie, err := New(TrieID(root), triedb)
+	if err != nil {
+		t.Fatalf("Failed to open reverted state: %v", err)
+	}
 	if !bytes.Equal(trie.Get([]byte("120000")), []byte("qwerqwerqwerqwerqwerqwerqwerqwer")) {
 		t.Fatal("wrong value")
 	}
-
-	trie, _ = New(TrieID(root2), triedb)
-	if !bytes.Equal(trie.Get([]byte("120000")), []byte("uiuiuiuiuiuiuiiuiui")) {
+	if !bytes.Equal(trie.Get([]byte("123456")), []byte("asdfasdfasdfasdfasdfasdfasdfasdf")) {
 		t.Fatal("wrong value")
 	}
+	if trie.Get([]byte("120099")) != nil {
+		t.Fatal("unexpected value")
+	}
+	// The uncommitted nodes of the reverted state are dropped from memory,
+	// there is no way back to the reverted states anymore.
+	if _, ok := triedb.dirties[root3]; ok {
+		t.Fatal("Reverted dirty state is still cached")
+	}
+	if err := triedb.Rollback(root2); err == nil {
+		t.Fatal("Expected error rolling back to a reverted state")
+	}
+	if err := triedb.Rollback(root); err != nil {
+		t.Fatalf("Rolling back to the current state failed: %v", err)
+	}
+	// The rollback position is persisted along with the reverse diffs,
+	// only the diff of the initial commit is left.
+	if head := NewTrieDB(diskdb).diffHead; head != 1 {
+		t.Fatalf("Unexpected reverse diff head: %d", head)
+	}
 }
 
+func TestParallelHash(t *testing.T) {
+	// Hash the same content once in a single batch, which is hashed
+	// concurrently, and once incrementally in small sequential steps.
+	var (
+		db         = NewTrieDB(NewMemoryDatabase())
+		parallel   = NewEmpty(db)
+		sequential = NewEmpty(db)
+	)
+	for i := 0; i < 1000; i++ {
+		key, val := randBytes(32), randBytes(20)
+		parallel.Update(key, val)
+		sequential.Update(key, val)
+		if i%50 == 0 {
+			sequential.Hash()
+		}
+		if sequential.unhashed >= 100 {
+			t.Fatalf("Sequential trie exceeded threshold: %d", sequential.unhashed)
+		}
+	}
+	if parallel.unhashed != 1000 {
+		t.Fatalf("Unhashed counter mismatch: have %d, want %d", parallel.unhashed, 1000)
+	}
+	if have, want := parallel.Hash(), sequential.Hash(); have != want {
+		t.Fatalf("Root mismatch: have %x, want %x", have, want)
+	}
+	if parallel.unhashed != 0 {
+		t.Fatalf("Unhashed counter not reset: %d", parallel.unhashed)
+	}
+}
+
+func TestCommitParallel(t *testing.T) {
+	triedb := NewTrieDB(NewMemoryDatabase())
+	trie, vals := randomTrie(2000)
+	trie.reader = triedb
+	root := commitTrie(trie, emptyRoot)
+
+	// Apply the same changes on two instances of the committed state,
+	// commit one of them sequentially and the other concurrently.
+	var (
+		changes    = make(map[string][]byte)
+		sequential = mustOpen(t, triedb, root)
+		parallel   = mustOpen(t, triedb, root)
+	)
+	for k := range vals {
+		if len(changes) == 200 {
+			break
+		}
+		changes[k] = nil // Delete
+	}
+	for i := 0; i < 500; i++ {
+		changes[string(randBytes(32))] = randBytes(20)
+	}
+	for k, v := range changes {
+		sequential.Update([]byte(k), v)
+		parallel.Update([]byte(k), v)
+	}
+	seqRoot, seqNodes, err := sequential.Commit(true)
+	if err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	parRoot, parNodes, err := parallel.CommitParallel(true)
+	if err != nil {
+		t.Fatalf("Failed to commit in parallel: %v", err)
+	}
+	if seqRoot != parRoot {
+		t.Fatalf("Root mismatch: sequential %x, parallel %x", seqRoot, parRoot)
+	}
+	// The node sets must be identical, including the node order.
+	type entry struct {
+		path string
+		hash common.Hash
+		oldv string
+	}
+	collect := func(set *NodeSet) (updated []entry, deleted []entry) {
+		set.ForEachUpdated(func(path []byte, hash common.Hash, blob []byte, oldv []byte) {
+			updated = append(updated, entry{string(path), hash, string(oldv)})
+		})
+		set.ForEachDeleted(func(path []byte, oldv []byte) {
+			deleted = append(deleted, entry{path: string(path), oldv: string(oldv)})
+		})
+		return updated, deleted
+	}
+	seqUpdated, seqDeleted := collect(seqNodes)
+	parUpdated, parDeleted := collect(parNodes)
+	if len(seqUpdated) != len(parUpdated) || len(seqDeleted) != len(parDeleted) {
+		t.Fatalf("Node set size mismatch: sequential %d/%d, parallel %d/%d",
+			len(seqUpdated), len(seqDeleted), len(parUpdated), len(parDeleted))
+	}
+	for i := range seqUpdated {
+		if seqUpdated[i] != parUpdated[i] {
+			t.Fatalf("Updated node %d mismatch: sequential %x, parallel %x", i, seqUpdated[i].path, parUpdated[i].path)
+		}
+	}
+	for i := range seqDeleted {
+		if seqDeleted[i] != parDeleted[i] {
+			t.Fatalf("Deleted node %d mismatch: sequential %x, parallel %x", i, seqDeleted[i].path, parDeleted[i].path)
+		}
+	}
+	if len(seqNodes.leaves) != len(parNodes.leaves) {
+		t.Fatalf("Leaf count mismatch: sequential %d, parallel %d", len(seqNodes.leaves), len(parNodes.leaves))
+	}
+	// The concurrently committed set can be flushed into the database. The
+	// leaves are no accounts, drop them to skip the storage trie linking.
+	parNodes.leaves = nil
+	merged := NewMergedNodeSet()
+	merged.Merge(parNodes)
+	if err := triedb.Update(parRoot, root, merged); err != nil {
+		t.Fatalf("Failed to update database: %v", err)
+	}
+	if err := triedb.Commit(parRoot); err != nil {
+		t.Fatalf("Failed to commit database: %v", err)
+	}
+	trie = mustOpen(t, triedb, parRoot)
+	for k, v := range changes {
+		if have := trie.Get([]byte(k)); !bytes.Equal(have, v) {
+			t.Fatalf("Value mismatch for %x: have %x, want %x", k, have, v)
+		}
+	}
+}
+
+func mustOpen(t *testing.T, db *TrieDB, root common.Hash) *Trie {
+	trie, err := New(TrieID(root), db)
+	if err != nil {
+		t.Fatalf("Failed to open trie %x: %v", root, err)
+	}
+	return trie
+}
+
+func TestCopy(t *testing.T) {
+	triedb := NewTrieDB(NewMemoryDatabase())
+	trie, vals := randomTrie(500)
+	trie.reader = triedb
+	root := commitTrie(trie, emptyRoot)
+
+	orig := mustOpen(t, triedb, root)
+	for k := range vals {
+		orig.Get([]byte(k)) // Resolve some nodes before forking
+		break
+	}
+	fork := orig.Copy()
+
+	// Speculatively modify the fork, the original must stay untouched.
+	var deleted []byte
+	for k := range vals {
+		deleted = []byte(k)
+		break
+	}
+	fork.Delete(deleted)
+	fork.Update(randBytes(32), randBytes(20))
+	if hash := orig.Hash(); hash != root {
+		t.Fatalf("Original trie modified: have %x, want %x", hash, root)
+	}
+	if v := orig.Get(deleted); !bytes.Equal(v, vals[string(deleted)].v) {
+		t.Fatalf("Original value lost: have %x, want %x", v, vals[string(deleted)].v)
+	}
+	forkRoot := fork.Hash()
+	if forkRoot == root {
+		t.Fatal("Fork not modified")
+	}
+	// Both tries commit independently, the fork reports its own changes.
+	_, nodes, err := fork.Commit(false)
+	if err != nil {
+		t.Fatalf("Failed to commit fork: %v", err)
+	}
+	if updated, _ := nodes.Size(); updated == 0 {
+		t.Fatal("Fork committed no nodes")
+	}
+	hash, nodes, err := orig.Commit(false)
+	if err != nil {
+		t.Fatalf("Failed to commit original: %v", err)
+	}
+	if hash != root || nodes != nil {
+		t.Fatalf("Original trie committed changes: root %x, nodes %v", hash, nodes)
+	}
+}
+
+func TestRollbackRetention(t *testing.T) {
+	diskdb := NewMemoryDatabase()
+	triedb := NewTrieDBWithConfig(diskdb, &Config{ReverseDiffs: 2})
+
+	var (
+		roots  []common.Hash
+		states []map[string]string
+		parent = emptyRoot
+	)
+	for i := 0; i < 4; i++ {
+		entries := map[string]string{string(randBytes(32)): string(randBytes(40))}
+		if i > 0 {
+			for k, v := range states[i-1] {
+				entries[k] = v
+			}
+		}
+		root := updateTrie(t, triedb, parent, entries)
+		if err := triedb.Commit(root); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+		roots, states, parent = append(roots, root), append(states, entries), root
+	}
+	// Only the two most recent reverse diffs are retained
+	for id := uint64(1); id <= 4; id++ {
+		ok, _ := diskdb.Has(reverseDiffKey(id))
+		if ok != (id > 2) {
+			t.Fatalf("Reverse diff %d: unexpected presence %v", id, ok)
+		}
+	}
+	// Rolling back to the current state is a noop
+	if err := triedb.Rollback(roots[3]); err != nil {
+		t.Fatalf("Failed to rollback to the current state: %v", err)
+	}
+	if triedb.diffHead != 4 {
+		t.Fatalf("Unexpected reverse diff head: %d", triedb.diffHead)
+	}
+	// The states beyond the retained diffs can't be reached
+	if err := triedb.Rollback(roots[0]); err == nil {
+		t.Fatal("Expected error rolling back beyond the retained diffs")
+	}
+	if err := triedb.Rollback(roots[1]); err != nil {
+		t.Fatalf("Failed to rollback: %v", err)
+	}
+	checkTrie(t, triedb, roots[1], states[1])
+}
 
-insert into trie
-delete from trie
-rollback to specific Hash
+func TestRollbackFork(t *testing.T) {
+	diskdb := NewMemoryDatabase()
+	triedb := NewTrieDB(diskdb)
 
-*/
+	extend := func(parent common.Hash, state map[string]string) (common.Hash, map[string]string) {
+		next := map[string]string{string(randBytes(32)): string(randBytes(40))}
+		for k, v := range state {
+			next[k] = v
+		}
+		return updateTrie(t, triedb, parent, next), next
+	}
+	rootA, stateA := extend(emptyRoot, nil)
+	if err := triedb.Commit(rootA); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	// Fork the state A into B and C, C is the most recent state
+	rootB, _ := extend(rootA, stateA)
+	rootC, _ := extend(rootA, stateA)
+
+	// The diff of the sibling B is skipped when reverting C
+	if err := triedb.Rollback(rootA); err != nil {
+		t.Fatalf("Failed to rollback: %v", err)
+	}
+	checkTrie(t, triedb, rootA, stateA)
+	if triedb.diffRoot != rootA {
+		t.Fatalf("Unexpected current state: have %x, want %x", triedb.diffRoot, rootA)
+	}
+	// The sibling B is not an ancestor of the current state A, neither is
+	// the reverted state C.
+	if err := triedb.Rollback(rootB); err == nil {
+		t.Fatal("Expected error rolling back to a sibling state")
+	}
+	if err := triedb.Rollback(rootC); err == nil {
+		t.Fatal("Expected error rolling back to a reverted state")
+	}
+	// The current state is persisted along with the diff head
+	if root := NewTrieDB(diskdb).diffRoot; root != rootA {
+		t.Fatalf("Unexpected persisted state: have %x, want %x", root, rootA)
+	}
+	// New updates on top of the current state can be reverted again
+	rootD, stateD := extend(rootA, stateA)
+	rootE, _ := extend(rootD, stateD)
+	if err := triedb.Rollback(rootD); err != nil {
+		t.Fatalf("Failed to rollback: %v", err)
+	}
+	if err := triedb.Rollback(rootE); err == nil {
+		t.Fatal("Expected error rolling back to a reverted state")
+	}
+	if err := triedb.Rollback(rootA); err != nil {
+		t.Fatalf("Failed to rollback: %v", err)
+	}
+	checkTrie(t, triedb, rootA, stateA)
+}
@@ -3,6 +3,7 @@ package trie
 import (
 	"fmt"
 	"io"
+	"reflect"
 
 	"github.com/jaiminpan/mt-trie/common"
 	"github.com/jaiminpan/mt-trie/rlp"
@@ -46,8 +47,8 @@ func (n rawShortNode) cache() (hashNode, bool)   { panic("this should never end
 func (n rawShortNode) fstring(ind string) string { panic("this should never end up in a live trie") }
 
 type cachedNode struct {
-	node node // Cached collapsed trie node, or raw rlp data
-	// size uint16 // Byte size of the useful cached data
+	node node   // Cached collapsed trie node, or raw rlp data
+	size uint16 // Byte size of the useful cached data
 
 	parents  uint32                 // Number of live nodes referencing this one
 	children map[common.Hash]uint16 // External children referenced by this node
@@ -56,6 +57,15 @@ type cachedNode struct {
 	flushNext common.Hash // Next node in the flush-list
 }
 
+// cachedNodeSize is the raw size of a cachedNode data structure without any
+// node data included. It's an approximate size, but should be a lot better
+// than not counting them.
+var cachedNodeSize = int(reflect.TypeOf(cachedNode{}).Size())
+
+// cachedNodeChildrenSize is the raw size of an initialized but empty external
+// reference map.
+const cachedNodeChildrenSize = 48
+
 // rlp returns the raw rlp encoded blob of the cached trie node, either directly
 // from the cache, or by regenerating it from the collapsed node.
 func (n *cachedNode) rlp() []byte {
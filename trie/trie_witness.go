@@ -0,0 +1,91 @@
+package trie
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/jaiminpan/mt-trie/accdb/memorydb"
+	"github.com/jaiminpan/mt-trie/common"
+)
+
+// EnableWitness turns on the witness collection of the trie. From now on all
+// the trie nodes loaded from the database are recorded, either by reads, by
+// the resolutions on the write paths, by proofs or by node iterators. The
+// nodes already loaded since the last commit are recorded as well, so a trie
+// can be opened first and switched to the witness mode afterwards.
+func (t *Trie) EnableWitness() {
+	if t.witness != nil {
+		return
+	}
+	t.witness = make(map[common.Hash][]byte)
+	if t.capture == nil {
+		return
+	}
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+
+	for _, blob := range t.capture.origin {
+		t.witness[common.BytesToHash(h.hashData(blob))] = blob
+	}
+}
+
+// Witness returns the rlp-encoded trie nodes recorded since the witness
+// collection was enabled, ordered by node hash. The nodes are sufficient for
+// a stateless verifier to re-execute the same accesses on top of the original
+// trie root, see NewWitnessDB. Nil is returned if the witness collection is
+// disabled.
+func (t *Trie) Witness() [][]byte {
+	if t.witness == nil {
+		return nil
+	}
+	hashes := make([]common.Hash, 0, len(t.witness))
+	for hash := range t.witness {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	witness := make([][]byte, 0, len(hashes))
+	for _, hash := range hashes {
+		witness = append(witness, t.witness[hash])
+	}
+	return witness
+}
+
+// copyWitness returns a copy of the recorded trie nodes, nil if the witness
+// collection is disabled.
+func (t *Trie) copyWitness() map[common.Hash][]byte {
+	if t.witness == nil {
+		return nil
+	}
+	witness := make(map[common.Hash][]byte, len(t.witness))
+	for hash, blob := range t.witness {
+		witness[hash] = blob
+	}
+	return witness
+}
+
+// recordWitness records the loaded trie node if the witness collection is
+// enabled.
+func (t *Trie) recordWitness(hash common.Hash, blob []byte) {
+	if t.witness == nil {
+		return
+	}
+	t.witness[hash] = blob
+}
+
+// NewWitnessDB creates an in-memory trie database containing only the trie
+// nodes of the given witness. The nodes are stored under their own hashes, so
+// a tampered node can't stand in for the one referenced by its parent. Tries
+// opened on top of it can serve all the accesses covered by the witness, any
+// other access reports a missing node.
+func NewWitnessDB(witness [][]byte) *TrieDB {
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+
+	diskdb := memorydb.New()
+	for _, blob := range witness {
+		diskdb.Put(h.hashData(blob), blob)
+	}
+	return NewTrieDB(diskdb)
+}
@@ -0,0 +1,182 @@
+package trie
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jaiminpan/mt-trie/accdb/memorydb"
+	"github.com/jaiminpan/mt-trie/common"
+)
+
+func TestWitness(t *testing.T) {
+	triedb := NewTrieDB(NewMemoryDatabase())
+	trie, vals := randomTrie(1000)
+	trie.reader = triedb
+	root := commitTrie(trie, emptyRoot)
+
+	// Collect the witness of a mix of reads, updates and deletions. The
+	// witness is enabled after opening, the root is recorded anyway.
+	var (
+		entries = sortedEntries(vals)
+		reads   = entries[:20]
+		deletes = entries[20:40]
+		updates = make(map[string][]byte)
+	)
+	for i := 0; i < 20; i++ {
+		updates[string(randBytes(32))] = randBytes(20)
+	}
+	for _, kv := range entries[40:60] {
+		updates[string(kv.k)] = randBytes(20)
+	}
+	apply := func(trie *Trie) (common.Hash, error) {
+		for _, kv := range reads {
+			v, err := trie.TryGet(kv.k)
+			if err != nil {
+				return common.Hash{}, err
+			}
+			if !bytes.Equal(v, kv.v) {
+				t.Fatalf("Value mismatch for %x: have %x, want %x", kv.k, v, kv.v)
+			}
+		}
+		for _, kv := range deletes {
+			if err := trie.TryDelete(kv.k); err != nil {
+				return common.Hash{}, err
+			}
+		}
+		for k, v := range updates {
+			if err := trie.TryUpdate([]byte(k), v); err != nil {
+				return common.Hash{}, err
+			}
+		}
+		return trie.Hash(), nil
+	}
+	trie = mustOpen(t, triedb, root)
+	if trie.Witness() != nil {
+		t.Fatal("Witness collected without being enabled")
+	}
+	trie.EnableWitness()
+	want, err := apply(trie)
+	if err != nil {
+		t.Fatalf("Failed to apply changes: %v", err)
+	}
+	witness := trie.Witness()
+	if !witnessHashes(witness)[root] {
+		t.Fatal("Root node missing from witness")
+	}
+	// The witness survives the commit of the trie.
+	if _, _, err := trie.Commit(false); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if len(trie.Witness()) != len(witness) {
+		t.Fatalf("Witness lost on commit: have %d nodes, want %d", len(trie.Witness()), len(witness))
+	}
+	// A stateless verifier re-executes the same accesses on the witness only.
+	verifier, err := New(TrieID(root), NewWitnessDB(witness))
+	if err != nil {
+		t.Fatalf("Failed to open trie on witness: %v", err)
+	}
+	have, err := apply(verifier)
+	if err != nil {
+		t.Fatalf("Failed to re-execute on witness: %v", err)
+	}
+	if have != want {
+		t.Fatalf("Root mismatch: have %x, want %x", have, want)
+	}
+	// Accesses not covered by the witness report missing nodes.
+	verifier, _ = New(TrieID(root), NewWitnessDB(witness))
+	for _, kv := range entries[60:] {
+		if _, err := verifier.TryGet(kv.k); err != nil {
+			if _, ok := err.(*MissingNodeError); !ok {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			return
+		}
+	}
+	t.Fatal("Witness covers the whole trie")
+}
+
+func TestWitnessTampered(t *testing.T) {
+	triedb := NewTrieDB(NewMemoryDatabase())
+	trie, vals := randomTrie(100)
+	trie.reader = triedb
+	root := commitTrie(trie, emptyRoot)
+
+	trie = mustOpen(t, triedb, root)
+	trie.EnableWitness()
+	entries := sortedEntries(vals)
+	for _, kv := range entries {
+		if _, err := trie.TryGet(kv.k); err != nil {
+			t.Fatalf("Failed to read %x: %v", kv.k, err)
+		}
+	}
+	// Replace the root node with another valid node, the nodes are keyed by
+	// their own hashes so the replacement can't be resolved as the root.
+	witness := trie.Witness()
+	hashes := witnessHashes(witness)
+	if !hashes[root] || len(hashes) < 2 {
+		t.Fatalf("Unexpected witness of %d nodes", len(hashes))
+	}
+	h := newHasher(false)
+	for i, blob := range witness {
+		if common.BytesToHash(h.hashData(blob)) == root {
+			witness[i] = witness[(i+1)%len(witness)]
+		}
+	}
+	returnHasherToPool(h)
+
+	if _, err := New(TrieID(root), NewWitnessDB(witness)); err == nil {
+		t.Fatal("Opened trie on tampered witness")
+	}
+}
+
+func TestWitnessProofAndIterator(t *testing.T) {
+	triedb := NewTrieDB(NewMemoryDatabase())
+	trie, vals := randomTrie(100)
+	trie.reader = triedb
+	root := commitTrie(trie, emptyRoot)
+
+	// The nodes loaded by proofs are recorded.
+	trie = mustOpen(t, triedb, root)
+	trie.EnableWitness()
+	entries := sortedEntries(vals)
+	proof := memorydb.New()
+	if err := trie.Prove(entries[0].k, proof); err != nil {
+		t.Fatalf("Failed to prove: %v", err)
+	}
+	recorded := witnessHashes(trie.Witness())
+	for it := proof.NewIterator(nil, nil); it.Next(); {
+		if !recorded[common.BytesToHash(it.Key())] {
+			t.Fatalf("Proof node %x missing from witness", it.Key())
+		}
+	}
+	// The nodes loaded by node iterators are recorded.
+	trie = mustOpen(t, triedb, root)
+	trie.EnableWitness()
+	var hashes []common.Hash
+	for it := trie.NodeIterator(nil); it.Next(true); {
+		if it.Hash() != (common.Hash{}) {
+			hashes = append(hashes, it.Hash())
+		}
+	}
+	recorded = witnessHashes(trie.Witness())
+	if len(recorded) != len(hashes) {
+		t.Fatalf("Witness size mismatch: have %d nodes, want %d", len(recorded), len(hashes))
+	}
+	for _, hash := range hashes {
+		if !recorded[hash] {
+			t.Fatalf("Iterated node %x missing from witness", hash)
+		}
+	}
+}
+
+// witnessHashes returns the set of node hashes in the given witness.
+func witnessHashes(witness [][]byte) map[common.Hash]bool {
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+
+	hashes := make(map[common.Hash]bool)
+	for _, blob := range witness {
+		hashes[common.BytesToHash(h.hashData(blob))] = true
+	}
+	return hashes
+}